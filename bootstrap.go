@@ -32,6 +32,8 @@ MAKE?=kati
 MAKE_VERSION?=3.81
 KATI?=kati
 SHELL=/bin/sh
+# Features of GNU make kati supports.
+.FEATURES:=target-specific order-only else-if
 # TODO: Add more builtin vars.
 
 # http://www.gnu.org/software/make/manual/make.html#Catalogue-of-Rules
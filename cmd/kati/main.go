@@ -18,11 +18,16 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"runtime/pprof"
+	"strings"
+	"syscall"
 	"text/template"
 	"time"
 
@@ -40,6 +45,8 @@ var (
 	saveJSON string
 	loadGOB  string
 	saveGOB  string
+	saveDot  string
+	saveCDB  string
 	useCache bool
 
 	m2n  bool
@@ -56,6 +63,42 @@ var (
 	regenNinja          bool
 	ninjaSuffix         string
 	gomaDir             string
+	gomaccPath          string
+	gomaJobs            int
+	localPoolDepth      int
+	linkPoolDepth       int
+	ninjaVersion        string
+	ninjaShortcuts      bool
+	recipeWrapper       string
+	useDistcc           bool
+	normalizeDepfile    bool
+	maxRuleNameLen      int
+	hoistInputs         bool
+	maxCommands         int
+	ninjaPolicy         string
+	strictDefault       bool
+	nonGCCDepfileTools  string
+	lastDepfileWins     bool
+	expandRspFiles      bool
+	allowDupBuild       bool
+	genAll              bool
+	genAllTargets       bool
+	omitHeader          bool
+	categorizeDesc      bool
+	descBasename        bool
+	showCommands        bool
+	gomaCompileRE       string
+	makefileWrapper     bool
+	collapsePhony       bool
+	ninjaKeepGoing      bool
+	errorOnMissing      bool
+	ninjaOutDir         string
+	rspfileForLinks     bool
+	emitProvenance      bool
+	regenIgnoreDirs     string
+	envAllow            string
+	envIgnore           string
+	envJSON             string
 	detectAndroidEcho   bool
 	shellDate           string
 )
@@ -69,6 +112,8 @@ func init() {
 	flag.StringVar(&saveGOB, "save", "", "")
 	flag.StringVar(&loadJSON, "load_json", "", "")
 	flag.StringVar(&saveJSON, "save_json", "", "")
+	flag.StringVar(&saveDot, "save_dot", "", "save the dependency graph of the targets in GraphViz's dot.")
+	flag.StringVar(&saveCDB, "save_compile_commands", "", "save compile commands as a clang compilation database.")
 	flag.BoolVar(&useCache, "use_cache", false, "Use cache.")
 
 	flag.BoolVar(&m2n, "m2n", false, "m2n mode")
@@ -85,6 +130,42 @@ func init() {
 	flag.BoolVar(&regenNinja, "gen_regen_rule", false, "Generate regenerate build.ninja rule.")
 	flag.StringVar(&ninjaSuffix, "ninja_suffix", "", "suffix for ninja files.")
 	flag.StringVar(&gomaDir, "goma_dir", "", "If specified, use goma to build C/C++ files.")
+	flag.StringVar(&gomaccPath, "gomacc", "", "gomacc command. gomacc in -goma_dir if empty.")
+	flag.StringVar(&gomaCompileRE, "goma_compile_re", "", "regexp of compile commands to run with goma. compilers in prebuilts if empty.")
+	flag.IntVar(&gomaJobs, "goma_jobs", 0, "number of parallel jobs of ninja with goma. 500 if zero.")
+	flag.IntVar(&localPoolDepth, "local_pool_depth", 0, "depth of local_pool for commands without goma. number of CPUs if zero.")
+	flag.IntVar(&linkPoolDepth, "link_pool_depth", 0, "depth of link_pool for link commands. link_pool is not used if zero.")
+	flag.StringVar(&envAllow, "env_allow", "", "space separated glob patterns of environment variables to be tracked.")
+	flag.StringVar(&envIgnore, "env_ignore", "", "space separated glob patterns of environment variables not to be tracked.")
+	flag.StringVar(&envJSON, "env_json", "", "write used environment variables as JSON to `file`.")
+	flag.StringVar(&regenIgnoreDirs, "regen_ignore_dirs", "", "space separated glob patterns of directories which don't trigger regeneration.")
+	flag.BoolVar(&ninjaShortcuts, "ninja_shortcuts", false, "emit phony targets for unique basenames of outputs.")
+	flag.BoolVar(&emitProvenance, "ninja_emit_provenance", false, "emit where rules are defined in makefiles as comments.")
+	flag.BoolVar(&rspfileForLinks, "ninja_rspfile_for_links", false, "always use rspfiles for link and archive commands.")
+	flag.StringVar(&ninjaOutDir, "ninja_out_dir", "", "write ninja files, ninja.sh and the env list in `dir`.")
+	flag.BoolVar(&errorOnMissing, "ninja_error_on_missing_input", false, "make prerequisites which are neither files nor targets an error.")
+	flag.BoolVar(&ninjaKeepGoing, "ninja_keep_going", false, "emit failing build statements for targets with errors, and report all of them.")
+	flag.BoolVar(&collapsePhony, "ninja_collapse_phony", false, "emit phony targets which only forward to other phony targets as aliases of the last one.")
+	flag.BoolVar(&makefileWrapper, "ninja_makefile_wrapper", false, "write Makefile which runs ninja.sh for any target.")
+	flag.BoolVar(&showCommands, "ninja_show_commands", false, "omit descriptions so ninja shows commands.")
+	flag.BoolVar(&descBasename, "ninja_description_basename", false, "use basenames of outputs in default descriptions.")
+	flag.BoolVar(&categorizeDesc, "ninja_categorize_descriptions", false, "prefix default descriptions of compile and link commands with [CC], [LD] etc.")
+	flag.BoolVar(&omitHeader, "ninja_omit_header", false, "omit the version of kati from generated files for reproducible output.")
+	flag.BoolVar(&genAll, "gen_all", false, "emit the whole graph to the ninja file even if targets are given.")
+	flag.BoolVar(&genAllTargets, "ninja_gen_all_targets", false, "emit all explicit targets to the ninja file, even unreachable ones.")
+	flag.BoolVar(&allowDupBuild, "ninja_allow_dup_build", false, "warn about outputs built by multiple rules instead of an error.")
+	flag.BoolVar(&expandRspFiles, "ninja_expand_response_files", false, "read @file arguments of compile commands to find their depfiles.")
+	flag.BoolVar(&lastDepfileWins, "ninja_last_depfile_wins", false, "use the last -MF of a compile command instead of an error.")
+	flag.StringVar(&nonGCCDepfileTools, "ninja_non_gcc_depfile_tools", "", "space separated glob patterns of commands whose depfiles are not gcc's format.")
+	flag.BoolVar(&strictDefault, "ninja_strict_default", false, "fail if the default target has no build statement in ninja.")
+	flag.StringVar(&ninjaPolicy, "ninja_policy", "", "JSON file of ninja attributes for outputs matching glob patterns.")
+	flag.IntVar(&maxCommands, "ninja_max_commands", 0, "warn about recipes with more commands than this.")
+	flag.BoolVar(&hoistInputs, "ninja_hoist_inputs", false, "emit phony targets for large input lists shared by build statements.")
+	flag.IntVar(&maxRuleNameLen, "ninja_max_rule_name_len", 0, "maximum length of rule names in ninja.")
+	flag.BoolVar(&normalizeDepfile, "normalize_depfile_flag", false, "add -MF to compile commands without it, instead of copying depfiles.")
+	flag.BoolVar(&useDistcc, "use_distcc", false, "run compile commands with distcc in ninja.")
+	flag.StringVar(&recipeWrapper, "recipe_wrapper", "", "space separated command line to run every recipe with in ninja.")
+	flag.StringVar(&ninjaVersion, "ninja_version", "", "version of ninja to generate build.ninja for.")
 	// TODO(ukai): implement --regen
 	flag.BoolVar(&detectAndroidEcho, "detect_android_echo", false, "detect echo as ninja description.")
 
@@ -95,6 +176,7 @@ func init() {
 	flag.BoolVar(&kati.EvalStatsFlag, "kati_eval_stats", false, "Show eval statistics")
 
 	flag.BoolVar(&kati.DryRunFlag, "n", false, "Only print the commands that would be executed")
+	flag.BoolVar(&kati.NormalizeFutureMtimeFlag, "normalize_future_mtime", false, "Reset modification time of files in the future")
 
 	// TODO: Make this default.
 	flag.BoolVar(&kati.UseFindEmulator, "use_find_emulator", false, "use find emulator")
@@ -150,6 +232,35 @@ func save(g *kati.DepGraph, targets []string) error {
 			err = serr
 		}
 	}
+	if saveDot != "" {
+		serr := saveToFile(saveDot, func(w io.Writer) error {
+			return kati.SaveGraphviz(g, w, targets)
+		})
+		if err == nil {
+			err = serr
+		}
+	}
+	if saveCDB != "" {
+		serr := saveToFile(saveCDB, func(w io.Writer) error {
+			return kati.SaveCompileCommands(g, w)
+		})
+		if err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+func saveToFile(filename string, save func(w io.Writer) error) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = save(f)
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
 	return err
 }
 
@@ -216,6 +327,7 @@ func main() {
 	if goma {
 		gomasetup()
 	}
+	handleSignals()
 	err := katiMain(args)
 	if err != nil {
 		fmt.Println(err)
@@ -224,6 +336,22 @@ func main() {
 	}
 }
 
+// handleSignals removes partially written files when kati is
+// interrupted, so they are not left next to generated files.
+func handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		kati.RemoveTemporaryFiles()
+		fmt.Printf("kati: %v\n", sig)
+		if s, ok := sig.(syscall.Signal); ok {
+			os.Exit(128 + int(s))
+		}
+		os.Exit(1)
+	}()
+}
+
 func katiMain(args []string) error {
 	defer glog.Flush()
 	if cpuprofile != "" {
@@ -272,6 +400,7 @@ func katiMain(args []string) error {
 	req.EnvironmentVars = os.Environ()
 	req.UseCache = useCache
 	req.EagerEvalCommand = eagerCmdEvalFlag
+	req.AllTargets = genAllTargets
 
 	g, err := load(req)
 	if err != nil {
@@ -289,10 +418,53 @@ func katiMain(args []string) error {
 			args = os.Args
 		}
 		n := kati.NinjaGenerator{
-			Args:              args,
-			Suffix:            ninjaSuffix,
-			GomaDir:           gomaDir,
-			DetectAndroidEcho: detectAndroidEcho,
+			Args:                   args,
+			Suffix:                 ninjaSuffix,
+			GomaDir:                gomaDir,
+			GomaccPath:             gomaccPath,
+			GomaJobs:               gomaJobs,
+			LocalPoolDepth:         localPoolDepth,
+			LinkPoolDepth:          linkPoolDepth,
+			DetectAndroidEcho:      detectAndroidEcho,
+			NinjaVersion:           ninjaVersion,
+			Shortcuts:              ninjaShortcuts,
+			RecipeWrapper:          strings.Fields(recipeWrapper),
+			NormalizeDepfileFlag:   normalizeDepfile,
+			MaxRuleNameLen:         maxRuleNameLen,
+			HoistInputs:            hoistInputs,
+			MaxCommands:            maxCommands,
+			PolicyPath:             ninjaPolicy,
+			StrictDefaultTarget:    strictDefault,
+			NonGCCDepfileTools:     strings.Fields(nonGCCDepfileTools),
+			LastDepfileWins:        lastDepfileWins,
+			ExpandResponseFiles:    expandRspFiles,
+			AllowDupBuild:          allowDupBuild,
+			GenAll:                 genAll,
+			GenAllTargets:          genAllTargets,
+			OmitHeader:             omitHeader,
+			CategorizeDescriptions: categorizeDesc,
+			DescriptionUseBasename: descBasename,
+			ShowCommands:           showCommands,
+			EmitMakefileWrapper:    makefileWrapper,
+			CollapsePhonyChains:    collapsePhony,
+			KeepGoing:              ninjaKeepGoing,
+			ErrorOnMissingInput:    errorOnMissing,
+			OutDir:                 ninjaOutDir,
+			RspfileForLinks:        rspfileForLinks,
+			EmitProvenance:         emitProvenance,
+			RegenIgnoreDirs:        strings.Fields(regenIgnoreDirs),
+			EnvAllow:               strings.Fields(envAllow),
+			EnvIgnore:              strings.Fields(envIgnore),
+			EnvJSONPath:            envJSON,
+		}
+		if useDistcc {
+			n.CompilerWrapper = kati.DistccCompilerWrapper
+		}
+		if gomaCompileRE != "" {
+			n.GomaCompileRE, err = regexp.Compile(gomaCompileRE)
+			if err != nil {
+				return err
+			}
 		}
 		return n.Save(g, "", req.Targets)
 	}
@@ -0,0 +1,127 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// compileCommand is an entry of a clang compilation database.
+type compileCommand struct {
+	Directory string `json:"directory"`
+	Command   string `json:"command"`
+	File      string `json:"file"`
+}
+
+// SaveCompileCommands writes compile commands of nodes in g to w as
+// a clang compilation database, i.e. compile_commands.json.  A command
+// is a compile command if it is matched by the same pattern used for
+// goma.  Other commands are not written.
+func SaveCompileCommands(g *DepGraph, w io.Writer) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	g.resolveVPATH()
+	ctx := newExecContext(g.vars, g.vpaths, true)
+	ccmds := []compileCommand{}
+	seen := make(map[*DepNode]bool)
+	var stack []*DepNode
+	for i := len(g.nodes) - 1; i >= 0; i-- {
+		stack = append(stack, g.nodes[i])
+	}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		children := nodeChildren(node)
+		for i := len(children) - 1; i >= 0; i-- {
+			stack = append(stack, children[i])
+		}
+
+		runners, _, err := createRunners(ctx, node)
+		if err != nil {
+			return nodeError(node, err)
+		}
+		for _, r := range runners {
+			cmd, ok := compileCmd(r.cmd)
+			if !ok {
+				continue
+			}
+			file := compileSource(node, cmd)
+			if file == "" {
+				continue
+			}
+			ccmds = append(ccmds, compileCommand{
+				Directory: wd,
+				Command:   cmd,
+				File:      file,
+			})
+		}
+	}
+	b, err := json.MarshalIndent(ccmds, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = w.Write(b)
+	return err
+}
+
+// compileCmd returns a command in a recipe line, without comments,
+// continuations, environment variables and ccache, and reports whether
+// it is a compile command.
+func compileCmd(cmd string) (string, bool) {
+	cmd = trimLeftSpace(stripShellComment(trimTailingSlash(cmd)))
+	cmd = strings.Replace(cmd, "\\\n\t", "", -1)
+	cmd = strings.Replace(cmd, "\\\n", "", -1)
+	cmd = strings.TrimRight(cmd, " \t\n;")
+	_, cmd = splitEnvPrefix(cmd)
+	return gomaCmdForAndroidCompileCmd(cmd)
+}
+
+// compileSource returns the source file compiled by cmd for node: an
+// input of node in cmd, preferably the one with the same stem as the
+// depfile of cmd.  It returns "" if no input is in cmd.
+func compileSource(node *DepNode, cmd string) string {
+	words := make(map[string]bool)
+	for _, w := range strings.Fields(cmd) {
+		words[w] = true
+	}
+	var stem string
+	if depfile, err := getDepfileImpl(cmd, depfileOpts{}); err == nil && depfile != "" {
+		stem = stripExt(filepath.Base(depfile))
+	}
+	var file string
+	for _, in := range node.ActualInputs {
+		if !words[in] {
+			continue
+		}
+		if stem != "" && stripExt(filepath.Base(in)) == stem {
+			return in
+		}
+		if file == "" {
+			file = in
+		}
+	}
+	return file
+}
@@ -0,0 +1,67 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSaveCompileCommands(t *testing.T) {
+	g := loadMakefileForTest(t, `
+CC := prebuilts/clang/linux-x86/host/3.6/bin/clang
+all: out/foo.o out/bar.o lib.a
+out/foo.o: foo.c foo.h
+	@mkdir -p out
+	$(CC) -MD -MF out/foo.d -c $< -o $@ # compile
+out/bar.o: foo.h bar.c
+	ccache $(CC) -c bar.c -o $@
+lib.a: out/foo.o
+	ar rcs $@ $^
+foo.c foo.h bar.c:
+`, nil)
+	var buf bytes.Buffer
+	err := SaveCompileCommands(g, &buf)
+	if err != nil {
+		t.Fatalf("SaveCompileCommands(g, w)=%v; want nil", err)
+	}
+	var got []compileCommand
+	err = json.Unmarshal(buf.Bytes(), &got)
+	if err != nil {
+		t.Fatalf("json.Unmarshal(%q)=%v", buf.String(), err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []compileCommand{
+		{
+			Directory: wd,
+			Command:   "prebuilts/clang/linux-x86/host/3.6/bin/clang -MD -MF out/foo.d -c foo.c -o out/foo.o",
+			File:      "foo.c",
+		},
+		{
+			Directory: wd,
+			Command:   "prebuilts/clang/linux-x86/host/3.6/bin/clang -c bar.c -o out/bar.o",
+			File:      "bar.c",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SaveCompileCommands(g, w)=%s; want %q", buf.String(), want)
+	}
+}
@@ -26,6 +26,7 @@ import (
 // DepNode represents a makefile rule for an output.
 type DepNode struct {
 	Output             string
+	ImplicitOutputs    []string
 	Cmds               []string
 	Deps               []*DepNode
 	OrderOnlys         []*DepNode
@@ -36,6 +37,11 @@ type DepNode struct {
 	TargetSpecificVars Vars
 	Filename           string
 	Lineno             int
+	Package            string
+	Pool               string
+	NotParallel        bool
+	Description        string
+	Generator          bool
 }
 
 func (n *DepNode) String() string {
@@ -56,6 +62,15 @@ type depBuilder struct {
 	vpaths      searchPaths
 	done        map[string]*DepNode
 	phony       map[string]bool
+	// notParallel is set by .NOTPARALLEL without prerequisites, and
+	// notParallelTargets is prerequisites of .NOTPARALLEL, whose
+	// prerequisites are built serially.
+	notParallel        bool
+	notParallelTargets map[string]bool
+	// oneShell is set by .ONESHELL, and deleteOnError is set by
+	// .DELETE_ON_ERROR.
+	oneShell      bool
+	deleteOnError bool
 
 	trace                         []string
 	nodeCnt                       int
@@ -291,7 +306,7 @@ func (db *depBuilder) buildPlan(output string, neededBy string, tsvs Vars) (*Dep
 		return n, nil
 	}
 
-	n := &DepNode{Output: output, IsPhony: db.phony[output]}
+	n := &DepNode{Output: output, IsPhony: db.phony[output], NotParallel: db.notParallel}
 	db.done[output] = n
 
 	// create depnode for phony targets?
@@ -366,6 +381,12 @@ func (db *depBuilder) buildPlan(output string, neededBy string, tsvs Vars) (*Dep
 		}
 	}
 
+	if db.notParallelTargets[output] {
+		for _, d := range n.Deps {
+			d.NotParallel = true
+		}
+	}
+
 	n.HasRule = true
 	n.Cmds = rule.cmds
 	n.ActualInputs = inputs
@@ -376,6 +397,33 @@ func (db *depBuilder) buildPlan(output string, neededBy string, tsvs Vars) (*Dep
 		}
 		n.TargetSpecificVars[k] = v
 	}
+	implicitOutputs, err := db.ruleVar(vars, ".KATI_IMPLICIT_OUTPUTS")
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range splitSpaces(implicitOutputs) {
+		n.ImplicitOutputs = append(n.ImplicitOutputs, trimLeadingCurdir(o))
+	}
+	pkg, err := db.ruleVar(vars, ".KATI_PACKAGE")
+	if err != nil {
+		return nil, err
+	}
+	n.Package = strings.TrimSpace(pkg)
+	pool, err := db.ruleVar(vars, ".KATI_NINJA_POOL")
+	if err != nil {
+		return nil, err
+	}
+	n.Pool = strings.TrimSpace(pool)
+	desc, err := db.ruleVar(vars, ".KATI_DESCRIPTION")
+	if err != nil {
+		return nil, err
+	}
+	n.Description = strings.TrimSpace(desc)
+	generator, err := db.ruleVar(vars, ".KATI_GENERATOR")
+	if err != nil {
+		return nil, err
+	}
+	n.Generator = strings.TrimSpace(generator) != ""
 	n.Filename = rule.filename
 	if len(rule.cmds) > 0 {
 		if rule.cmdLineno > 0 {
@@ -387,6 +435,16 @@ func (db *depBuilder) buildPlan(output string, neededBy string, tsvs Vars) (*Dep
 	return n, nil
 }
 
+// ruleVar evaluates a variable defined for the rule itself, such as
+// .KATI_IMPLICIT_OUTPUTS.  Target specific variables inherited from
+// parents are not considered.
+func (db *depBuilder) ruleVar(vars Vars, name string) (string, error) {
+	if _, present := vars[name]; !present {
+		return "", nil
+	}
+	return db.ev.EvaluateVar(name)
+}
+
 func (db *depBuilder) populateSuffixRule(r *rule, output string) bool {
 	if len(output) == 0 || output[0] != '.' {
 		return false
@@ -557,15 +615,47 @@ func newDepBuilder(er *evalResult, vars Vars) (*depBuilder, error) {
 			db.phony[input] = true
 		}
 	}
+	_, db.oneShell = db.rules[".ONESHELL"]
+	_, db.deleteOnError = db.rules[".DELETE_ON_ERROR"]
+	rule, present = db.rules[".NOTPARALLEL"]
+	if present {
+		db.notParallel = len(rule.inputs) == 0
+		db.notParallelTargets = make(map[string]bool)
+		for _, input := range rule.inputs {
+			db.notParallelTargets[input] = true
+		}
+	}
 	return db, nil
 }
 
+// defaultGoal returns the target to build when no targets are given,
+// i.e. .DEFAULT_GOAL if set, or the first target.
+func (db *depBuilder) defaultGoal() (string, error) {
+	v, err := db.ev.EvaluateVar(".DEFAULT_GOAL")
+	if err != nil {
+		return "", err
+	}
+	goals := splitSpaces(v)
+	switch len(goals) {
+	case 0:
+	case 1:
+		return goals[0], nil
+	default:
+		return "", fmt.Errorf("*** .DEFAULT_GOAL contains more than one target.")
+	}
+	if db.firstRule == nil {
+		return "", fmt.Errorf("*** No targets.")
+	}
+	return db.firstRule.outputs[0], nil
+}
+
 func (db *depBuilder) Eval(targets []string) ([]*DepNode, error) {
 	if len(targets) == 0 {
-		if db.firstRule == nil {
-			return nil, fmt.Errorf("*** No targets.")
+		goal, err := db.defaultGoal()
+		if err != nil {
+			return nil, err
 		}
-		targets = append(targets, db.firstRule.outputs[0])
+		targets = append(targets, goal)
 		var phonys []string
 		for t := range db.phony {
 			phonys = append(phonys, t)
@@ -594,3 +684,33 @@ func (db *depBuilder) Eval(targets []string) ([]*DepNode, error) {
 	db.reportStats()
 	return nodes, nil
 }
+
+// evalUnreached returns nodes for explicit targets of rules which are
+// not reached by Eval, in sorted order.  Special targets such as
+// .PHONY, which start with '.' and have no '/', are not included.
+func (db *depBuilder) evalUnreached() ([]*DepNode, error) {
+	var targets []string
+	for t := range db.rules {
+		if _, reached := db.done[t]; reached {
+			continue
+		}
+		if strings.HasPrefix(t, ".") && !strings.Contains(t, "/") {
+			continue
+		}
+		targets = append(targets, t)
+	}
+	sort.Strings(targets)
+	var nodes []*DepNode
+	for _, target := range targets {
+		if _, reached := db.done[target]; reached {
+			continue
+		}
+		db.trace = []string{target}
+		n, err := db.buildPlan(target, "", make(Vars))
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
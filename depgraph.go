@@ -31,6 +31,15 @@ type DepGraph struct {
 	accessedMks []*accessedMakefile
 	exports     map[string]bool
 	vpaths      searchPaths
+	// globDirs is directories scanned by $(wildcard) or wildcards
+	// in rules.
+	globDirs []string
+	// oneShell is set by .ONESHELL, with which all lines of a recipe
+	// run in a shell.
+	oneShell bool
+	// deleteOnError is set by .DELETE_ON_ERROR, with which outputs
+	// of failed recipes are removed.
+	deleteOnError bool
 }
 
 // Nodes returns all rules.
@@ -76,6 +85,9 @@ type LoadReq struct {
 	EnvironmentVars  []string
 	UseCache         bool
 	EagerEvalCommand bool
+	// AllTargets also loads explicit targets of rules which are not
+	// reachable from Targets, after them.
+	AllTargets bool
 }
 
 // FromCommandLine creates LoadReq from given command line.
@@ -162,7 +174,7 @@ func Load(req LoadReq) (*DepGraph, error) {
 	if err != nil {
 		return nil, err
 	}
-	er, err := eval(mk, vars, req.UseCache)
+	er, err := eval(mk, vars)
 	if err != nil {
 		return nil, err
 	}
@@ -183,6 +195,13 @@ func Load(req LoadReq) (*DepGraph, error) {
 	if err != nil {
 		return nil, err
 	}
+	if req.AllTargets {
+		unreached, err := db.evalUnreached()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, unreached...)
+	}
 	logStats("dep build time: %q", time.Since(startTime))
 	var accessedMks []*accessedMakefile
 	// Always put the root Makefile as the first element.
@@ -193,11 +212,14 @@ func Load(req LoadReq) (*DepGraph, error) {
 	})
 	accessedMks = append(accessedMks, er.accessedMks...)
 	gd := &DepGraph{
-		nodes:       nodes,
-		vars:        vars,
-		accessedMks: accessedMks,
-		exports:     er.exports,
-		vpaths:      er.vpaths,
+		nodes:         nodes,
+		vars:          vars,
+		accessedMks:   accessedMks,
+		exports:       er.exports,
+		vpaths:        er.vpaths,
+		globDirs:      fsCache.globbedDirs(),
+		oneShell:      db.oneShell,
+		deleteOnError: db.deleteOnError,
 	}
 	if req.EagerEvalCommand {
 		startTime := time.Now()
@@ -161,6 +161,10 @@ type Evaluator struct {
 	exports      map[string]bool
 	vpaths       []vpath
 
+	// expanding is names of recursive variables being expanded, to
+	// detect self references.
+	expanding []string
+
 	avoidIO bool
 	hasIO   bool
 	// delayedOutputs are commands which should run at ninja-time
@@ -212,6 +216,10 @@ func (ev *Evaluator) evalAssign(ast *assignAST) error {
 	if lhs == "" {
 		return ast.errorf("*** empty variable name.")
 	}
+	if lhs == ".FEATURES" && ast.filename != bootstrapMakefileName {
+		warn(ast.srcpos, "ignoring assignment to read-only variable %s", lhs)
+		return nil
+	}
 	ev.outVars.Assign(lhs, rhs)
 	return nil
 }
@@ -673,11 +681,11 @@ func (ev *Evaluator) eval(stmt ast) error {
 	return stmt.eval(ev)
 }
 
-func eval(mk makefile, vars Vars, useCache bool) (er *evalResult, err error) {
+func eval(mk makefile, vars Vars) (er *evalResult, err error) {
 	ev := NewEvaluator(vars)
-	if useCache {
-		ev.cache = newAccessCache()
-	}
+	// Always track accessed makefiles. They are used to validate
+	// the cache, and as dependencies of the regen rule of ninja.
+	ev.cache = newAccessCache()
 
 	makefileList := vars.Lookup("MAKEFILE_LIST")
 	if !makefileList.IsDefined() {
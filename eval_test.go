@@ -0,0 +1,295 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func evalForTest(mk string) (*evalResult, error) {
+	m, err := parseMakefile([]byte(mk), "Makefile")
+	if err != nil {
+		return nil, err
+	}
+	return eval(m, make(Vars))
+}
+
+// expandForTest evaluates mk, and then expands $(name).
+func expandForTest(mk, name string) (string, error) {
+	er, err := evalForTest(mk)
+	if err != nil {
+		return "", err
+	}
+	return NewEvaluator(er.vars).EvaluateVar(name)
+}
+
+func TestRecursiveVarReferencesItself(t *testing.T) {
+	for _, tc := range []struct {
+		mk   string
+		want string
+	}{
+		{
+			mk:   "A = $(A)\nX := $(A)\n",
+			want: "Makefile:2: *** Recursive variable 'A' references itself (eventually): A -> A",
+		},
+		{
+			mk:   "A = a $(B)\nB = b $(C)\nC = c $(A)\nX := $(A)\n",
+			want: "Makefile:4: *** Recursive variable 'A' references itself (eventually): A -> B -> C -> A",
+		},
+	} {
+		_, err := evalForTest(tc.mk)
+		if err == nil {
+			t.Errorf("eval %q: no error; want %q", tc.mk, tc.want)
+			continue
+		}
+		if got := err.Error(); got != tc.want {
+			t.Errorf("eval %q: error %q; want %q", tc.mk, got, tc.want)
+		}
+	}
+
+	// Simple variables and repeated references are not recursion.
+	got, err := expandForTest("A := a\nA := $(A) b\nB = $(A) $(A)\n", "B")
+	if err != nil {
+		t.Fatalf("expand $(B): %v", err)
+	}
+	if want := "a b a b"; got != want {
+		t.Errorf("expand $(B)=%q; want=%q", got, want)
+	}
+}
+
+func TestKatiAssert(t *testing.T) {
+	for _, tc := range []struct {
+		mk      string
+		want    string
+		wantErr string
+	}{
+		{
+			mk:   "X := [$(KATI_assert a,not reached)]\n",
+			want: "[]",
+		},
+		{
+			mk:   "A := a\nX := [$(KATI_assert $(filter a,$(A)),A is not a)]\n",
+			want: "[]",
+		},
+		{
+			mk:      "A := b\nX := [$(KATI_assert $(filter a,$(A)),A is $(A))]\n",
+			wantErr: "Makefile:2: *** A is b.",
+		},
+		{
+			mk:      "\nX := $(KATI_assert  ,empty)\n",
+			wantErr: "Makefile:2: *** empty.",
+		},
+	} {
+		got, err := expandForTest(tc.mk, "X")
+		if tc.wantErr != "" {
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("expand %q: error %v; want %q", tc.mk, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expand %q: %v", tc.mk, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("expand %q=%q; want=%q", tc.mk, got, tc.want)
+		}
+	}
+}
+
+func TestKatiShellIn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sub := filepath.Join(dir, "sub")
+	err = os.Mkdir(sub, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(sub, "marker"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+	for _, tc := range []struct {
+		mk      string
+		want    string
+		wantErr string
+	}{
+		{
+			mk:   "SHELL := /bin/sh\nX := $(KATI_shell_in " + sub + ",ls)\n",
+			want: "marker",
+		},
+		{
+			mk:   "SHELL := /bin/sh\nD := " + dir + "\nX := $(KATI_shell_in $(D)/sub ,ls; ls ..)\n",
+			want: "marker sub",
+		},
+		{
+			mk:      "SHELL := /bin/sh\nX := $(KATI_shell_in " + missing + ",ls)\n",
+			wantErr: "Makefile:2: *** \"KATI_shell_in\" function: ",
+		},
+		{
+			mk:      "SHELL := /bin/sh\nX := $(KATI_shell_in ,ls)\n",
+			wantErr: `Makefile:2: *** empty directory for "KATI_shell_in" function.`,
+		},
+	} {
+		got, err := expandForTest(tc.mk, "X")
+		if tc.wantErr != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+				t.Errorf("expand %q: error %v; want %q", tc.mk, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expand %q: %v", tc.mk, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("expand %q=%q; want=%q", tc.mk, got, tc.want)
+		}
+	}
+}
+
+func TestEmptyForeachAndCall(t *testing.T) {
+	for _, tc := range []struct {
+		mk   string
+		want string
+	}{
+		{mk: "X := [$(foreach v,,$(v) x)]\n", want: "[]"},
+		{mk: "X := [$(foreach v, ,$(v) x)]\n", want: "[]"},
+		{mk: "E :=\nX := [$(foreach v,$(E),$(v) x)]\n", want: "[]"},
+		{mk: "f = $1\nX := [$(call f)]\n", want: "[]"},
+		{mk: "f = $(1)$(2)\nX := [$(call f,)]\n", want: "[]"},
+		{mk: "f = $(foreach v,$1,<$(v)>)\nX := [$(call f)]\n", want: "[]"},
+		// as GNU make, spaces in the body are kept.
+		{mk: "f = $(1) $(2)\nX := [$(call f)]\n", want: "[ ]"},
+		{mk: "X := [$(foreach v,a b,)]\n", want: "[ ]"},
+	} {
+		got, err := expandForTest(tc.mk, "X")
+		if err != nil {
+			t.Errorf("expand %q: %v", tc.mk, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("expand %q=%q; want=%q", tc.mk, got, tc.want)
+		}
+	}
+}
+
+func TestElseIfChain(t *testing.T) {
+	const chain = `
+ifeq ($(A),1)
+X := one
+else ifeq ($(A),2)
+X := two
+else
+X := other
+endif
+Y := after
+`
+	for _, tc := range []struct {
+		mk   string
+		want string
+	}{
+		{mk: "A := 1\n" + chain, want: "one"},
+		{mk: "A := 2\n" + chain, want: "two"},
+		{mk: "A := 3\n" + chain, want: "other"},
+		{mk: "A := 2\nifdef B\nX := b\nelse ifndef A\nX := a\nelse ifneq ($(A),2)\nX := c\nelse\nX := d\nendif\n", want: "d"},
+		// a nested conditional in a branch needs its own endif.
+		{mk: "A := 2\nifeq ($(A),1)\nX := one\nelse ifeq ($(A),2)\nifdef B\nX := b\nelse\nX := nob\nendif\nelse\nX := other\nendif\n", want: "nob"},
+	} {
+		got, err := expandForTest(tc.mk, "X")
+		if err != nil {
+			t.Errorf("expand %q: %v", tc.mk, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("expand %q=%q; want=%q", tc.mk, got, tc.want)
+		}
+	}
+
+	// the chain is closed by a single endif.
+	got, err := expandForTest("A := 2\n"+chain, "Y")
+	if err != nil || got != "after" {
+		t.Errorf("$(Y)=%q, %v; want=%q", got, err, "after")
+	}
+
+	_, err = evalForTest("ifdef A\nelse\nelse ifdef B\nendif\n")
+	if err == nil {
+		t.Errorf("else ifdef after else: no error")
+	}
+}
+
+// expandWithBootstrapForTest evaluates mk after the bootstrap
+// makefile, and then expands $(name).
+func expandWithBootstrapForTest(mk, name string) (string, error) {
+	bmk, err := bootstrapMakefile(nil)
+	if err != nil {
+		return "", err
+	}
+	m, err := parseMakefile([]byte(mk), "Makefile")
+	if err != nil {
+		return "", err
+	}
+	m.stmts = append(bmk.stmts, m.stmts...)
+	er, err := eval(m, make(Vars))
+	if err != nil {
+		return "", err
+	}
+	return NewEvaluator(er.vars).EvaluateVar(name)
+}
+
+func TestFeatures(t *testing.T) {
+	for _, tc := range []struct {
+		mk   string
+		want string
+	}{
+		{mk: "X := $(filter order-only target-specific,$(.FEATURES))", want: "target-specific order-only"},
+		{mk: "X := $(filter second-expansion jobserver,$(.FEATURES))", want: ""},
+		{mk: "ifneq ($(filter else-if,$(.FEATURES)),)\nX := yes\nelse\nX := no\nendif", want: "yes"},
+		{mk: ".FEATURES := none\nX := $(filter else-if,$(.FEATURES))", want: "else-if"},
+	} {
+		got, err := expandWithBootstrapForTest(tc.mk, "X")
+		if err != nil {
+			t.Errorf("expand %q: %v", tc.mk, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("expand %q=%q; want=%q", tc.mk, got, tc.want)
+		}
+	}
+}
+
+func TestCurdir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"CURDIR", "PWD"} {
+		got, err := expandWithBootstrapForTest("CURDIR_ := $(CURDIR)\nPWD_ := $(shell pwd)\n", name+"_")
+		if err != nil {
+			t.Fatalf("expand $(%s): %v", name, err)
+		}
+		if got != wd {
+			t.Errorf("$(%s)=%q; want=%q", name, got, wd)
+		}
+	}
+}
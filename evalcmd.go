@@ -25,6 +25,8 @@ import (
 
 type execContext struct {
 	shell string
+	// shellFlags is .SHELLFLAGS, or "-c" if it is empty.
+	shellFlags string
 
 	mu     sync.Mutex
 	ev     *Evaluator
@@ -63,6 +65,12 @@ func newExecContext(vars Vars, vpaths searchPaths, avoidIO bool) *execContext {
 		shell = "/bin/sh"
 	}
 	ctx.shell = shell
+	flags, err := ev.EvaluateVar(".SHELLFLAGS")
+	flags = strings.TrimSpace(flags)
+	if err != nil || flags == "" {
+		flags = "-c"
+	}
+	ctx.shellFlags = flags
 	return ctx
 }
 
@@ -195,6 +203,7 @@ type runner struct {
 	echo        bool
 	ignoreError bool
 	shell       string
+	shellFlags  string
 }
 
 func (r runner) String() string {
@@ -252,11 +261,19 @@ func (r runner) eval(ev *Evaluator, s string) ([]runner, error) {
 	buf.release()
 	glog.V(1).Infof("evalcmd: %q => %q", r.cmd, cmds)
 	var runners []runner
-	for _, cmd := range strings.Split(cmds, "\n") {
-		if len(runners) > 0 && strings.HasSuffix(runners[len(runners)-1].cmd, "\\") {
-			runners[len(runners)-1].cmd += "\n"
-			runners[len(runners)-1].cmd += cmd
-			continue
+	lines := strings.Split(cmds, "\n")
+	for i := 0; i < len(lines); i++ {
+		cmd := lines[i]
+		if strings.HasSuffix(cmd, "\\") {
+			// join continued lines at once, rather than appending
+			// to the command one by one, which is quadratic for
+			// a large recipe made by $(foreach).
+			j := i
+			for j+1 < len(lines) && strings.HasSuffix(lines[j], "\\") {
+				j++
+			}
+			cmd = strings.Join(lines[i:j+1], "\n")
+			i = j
 		}
 		runners = append(runners, r.forCmd(cmd))
 	}
@@ -272,7 +289,12 @@ func (r runner) run(output string) error {
 	if DryRunFlag {
 		return nil
 	}
-	args := []string{r.shell, "-c", s}
+	args := []string{r.shell}
+	if r.shellFlags == "" {
+		args = append(args, "-c")
+	}
+	args = append(args, strings.Fields(r.shellFlags)...)
+	args = append(args, s)
 	cmd := exec.Cmd{
 		Path: args[0],
 		Args: args,
@@ -311,9 +333,10 @@ func createRunners(ctx *execContext, n *DepNode) ([]runner, bool, error) {
 	ctx.ev.lineno = n.Lineno
 	glog.Infof("Building: %s cmds:%q", n.Output, n.Cmds)
 	r := runner{
-		output: n.Output,
-		echo:   true,
-		shell:  ctx.shell,
+		output:     n.Output,
+		echo:       true,
+		shell:      ctx.shell,
+		shellFlags: ctx.shellFlags,
 	}
 	for _, cmd := range n.Cmds {
 		rr, err := r.eval(ctx.ev, cmd)
@@ -329,8 +352,9 @@ func createRunners(ctx *execContext, n *DepNode) ([]runner, bool, error) {
 	if len(ctx.ev.delayedOutputs) > 0 {
 		var nrunners []runner
 		r := runner{
-			output: n.Output,
-			shell:  ctx.shell,
+			output:     n.Output,
+			shell:      ctx.shell,
+			shellFlags: ctx.shellFlags,
 		}
 		for _, o := range ctx.ev.delayedOutputs {
 			nrunners = append(nrunners, r.forCmd(o))
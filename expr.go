@@ -160,8 +160,21 @@ func (v *varref) Eval(w evalWriter, ev *Evaluator) error {
 	if err != nil {
 		return err
 	}
-	vv := ev.LookupVar(buf.String())
+	name := buf.String()
+	vv := ev.LookupVar(name)
 	buf.release()
+	if vv.Flavor() == "recursive" {
+		for i, n := range ev.expanding {
+			if n == name {
+				chain := append(append([]string(nil), ev.expanding[i:]...), name)
+				return ev.errorf("*** Recursive variable '%s' references itself (eventually): %s", name, strings.Join(chain, " -> "))
+			}
+		}
+		ev.expanding = append(ev.expanding, name)
+		defer func() {
+			ev.expanding = ev.expanding[:len(ev.expanding)-1]
+		}()
+	}
 	err = vv.Eval(w, ev)
 	if err != nil {
 		return err
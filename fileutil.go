@@ -17,6 +17,7 @@ package kati
 import (
 	"os"
 	"path/filepath"
+	"sync"
 )
 
 func exists(filename string) bool {
@@ -27,6 +28,65 @@ func exists(filename string) bool {
 	return true
 }
 
+// atomicFile is a file written as filename.tmp, and renamed to
+// filename on success, so filename is never truncated.
+type atomicFile struct {
+	*os.File
+	filename string
+}
+
+// writingFiles is atomicFiles being written.
+var writingFiles = struct {
+	mu sync.Mutex
+	m  map[*atomicFile]bool
+}{m: make(map[*atomicFile]bool)}
+
+func createAtomic(filename string) (*atomicFile, error) {
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	af := &atomicFile{File: f, filename: filename}
+	writingFiles.mu.Lock()
+	writingFiles.m[af] = true
+	writingFiles.mu.Unlock()
+	return af, nil
+}
+
+// finish closes f, and renames it to the filename if err is nil.
+// Otherwise, it removes f.  It returns err, or an error of closing or
+// renaming.
+func (f *atomicFile) finish(err error) error {
+	writingFiles.mu.Lock()
+	delete(writingFiles.m, f)
+	writingFiles.mu.Unlock()
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), f.filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// RemoveTemporaryFiles removes temporary files of generated files
+// which are being written, e.g. when kati is interrupted.  The
+// generated files are not changed, as they are replaced only when
+// they are completely written.
+func RemoveTemporaryFiles() {
+	writingFiles.mu.Lock()
+	defer writingFiles.mu.Unlock()
+	for f := range writingFiles.m {
+		f.Close()
+		os.Remove(f.Name())
+		delete(writingFiles.m, f)
+	}
+}
+
 type vpath struct {
 	pattern string
 	dirs    []string
@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAtomicFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "build.ninja")
+	err = ioutil.WriteFile(filename, []byte("old\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{err: errors.New("failed"), want: "old\n"},
+		{want: "new\n"},
+	} {
+		f, err := createAtomic(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString("new\n")
+		err = f.finish(tc.err)
+		if err != tc.err {
+			t.Errorf("finish(%v)=%v; want=%v", tc.err, err, tc.err)
+		}
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != tc.want {
+			t.Errorf("finish(%v): %s=%q; want=%q", tc.err, filename, got, tc.want)
+		}
+		if exists(filename + ".tmp") {
+			t.Errorf("finish(%v): %s.tmp exists", tc.err, filename)
+		}
+	}
+}
+
+func TestRemoveTemporaryFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "build.ninja")
+	err = ioutil.WriteFile(filename, []byte("old\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := createAtomic(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("partial")
+
+	// as kati is interrupted.
+	RemoveTemporaryFiles()
+	if exists(filename + ".tmp") {
+		t.Errorf("%s.tmp exists after RemoveTemporaryFiles", filename)
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "old\n"; got != want {
+		t.Errorf("%s=%q; want=%q", filename, got, want)
+	}
+	if err := f.finish(nil); err == nil {
+		t.Errorf("finish after RemoveTemporaryFiles: no error")
+	}
+	b, err = ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "old\n"; got != want {
+		t.Errorf("after finish %s=%q; want=%q", filename, got, want)
+	}
+}
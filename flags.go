@@ -22,6 +22,10 @@ var (
 
 	DryRunFlag bool
 
+	// NormalizeFutureMtimeFlag resets mtime of files in the future
+	// to the current time.
+	NormalizeFutureMtimeFlag bool
+
 	UseFindEmulator  bool
 	UseShellBuiltins bool
 
@@ -89,6 +89,9 @@ var (
 		"info":    func() mkFunc { return &funcInfo{} },
 		"warning": func() mkFunc { return &funcWarning{} },
 		"error":   func() mkFunc { return &funcError{} },
+
+		"KATI_assert":   func() mkFunc { return &funcKatiAssert{} },
+		"KATI_shell_in": func() mkFunc { return &funcKatiShellIn{} },
 	}
 )
 
@@ -131,6 +134,12 @@ func (c *fclosure) AddArg(v Value) {
 	c.args = append(c.args, v)
 }
 
+// fargs returns the arguments of the function, the first of which is
+// "(funcname", or "{funcname".
+func (c *fclosure) fargs() []Value {
+	return c.args
+}
+
 func (c *fclosure) String() string {
 	if len(c.args) == 0 {
 		return "$(func)"
@@ -959,30 +968,80 @@ func (f *funcShell) Eval(w evalWriter, ev *Evaluator) error {
 		return nil
 	}
 
+	return runShell(w, ev, arg, "")
+}
+
+// runShell runs arg with $(SHELL) in dir, or in the current directory
+// if dir is empty, and writes its output to w as $(shell) does.
+func runShell(w evalWriter, ev *Evaluator, arg, dir string) error {
 	shellVar, err := ev.EvaluateVar("SHELL")
 	if err != nil {
 		return err
 	}
 	cmdline := []string{shellVar, "-c", arg}
 	if glog.V(1) {
-		glog.Infof("shell %q", cmdline)
+		glog.Infof("shell %q in %q", cmdline, dir)
 	}
 	cmd := exec.Cmd{
 		Path:   cmdline[0],
 		Args:   cmdline,
+		Dir:    dir,
 		Stderr: os.Stderr,
 	}
 	te := traceEvent.begin("shell", literal(arg), traceEventMain)
 	out, err := cmd.Output()
 	shellStats.add(time.Since(te.t))
 	if err != nil {
-		glog.Warningf("$(shell %q) failed: %q", arg, err)
+		glog.Warningf("$(shell %q) in %q failed: %q", arg, dir, err)
 	}
 	w.Write(formatCommandOutput(out))
 	traceEvent.end(te)
 	return nil
 }
 
+// funcKatiShellIn is $(KATI_shell_in dir,cmd).  It is $(shell cmd)
+// run in dir, which must exist.  In recipes of ninja, it becomes
+// $(cd dir && cmd), and dir is checked when the recipe runs.
+type funcKatiShellIn struct{ fclosure }
+
+func (f *funcKatiShellIn) Arity() int { return 2 }
+func (f *funcKatiShellIn) Eval(w evalWriter, ev *Evaluator) error {
+	err := assertArity("KATI_shell_in", 2, len(f.args))
+	if err != nil {
+		return err
+	}
+	abuf := newEbuf()
+	err = f.args[1].Eval(abuf, ev)
+	if err != nil {
+		return err
+	}
+	dir := string(trimSpaceBytes(abuf.Bytes()))
+	abuf.release()
+	abuf = newEbuf()
+	err = f.args[2].Eval(abuf, ev)
+	if err != nil {
+		return err
+	}
+	arg := abuf.String()
+	abuf.release()
+	if dir == "" {
+		return ev.errorf(`*** empty directory for "KATI_shell_in" function.`)
+	}
+	if ev.avoidIO {
+		ev.hasIO = true
+		fmt.Fprintf(w, "$(cd %s && %s)", shellQuote(dir), arg)
+		return nil
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return ev.errorf(`*** "KATI_shell_in" function: %v.`, err)
+	}
+	if !fi.IsDir() {
+		return ev.errorf(`*** "KATI_shell_in" function: %s is not a directory.`, dir)
+	}
+	return runShell(w, ev, arg, dir)
+}
+
 func (f *funcShell) Compact() Value {
 	if len(f.args)-1 < 1 {
 		return f
@@ -1419,6 +1478,44 @@ func (f *funcError) Eval(w evalWriter, ev *Evaluator) error {
 	return ev.errorf("*** %s.", abuf.String())
 }
 
+// funcKatiAssert is $(KATI_assert cond,message).  It is $(error message)
+// if cond is empty, or expands to nothing otherwise.
+type funcKatiAssert struct{ fclosure }
+
+func (f *funcKatiAssert) Arity() int { return 2 }
+func (f *funcKatiAssert) Eval(w evalWriter, ev *Evaluator) error {
+	err := assertArity("KATI_assert", 2, len(f.args))
+	if err != nil {
+		return err
+	}
+	abuf := newEbuf()
+	err = f.args[1].Eval(abuf, ev)
+	if err != nil {
+		return err
+	}
+	cond := len(bytes.TrimSpace(abuf.Bytes())) != 0
+	abuf.release()
+	if cond {
+		return nil
+	}
+	var mbuf evalBuffer
+	mbuf.resetSep()
+	err = f.args[2].Eval(&mbuf, ev)
+	if err != nil {
+		return err
+	}
+	msg := mbuf.String()
+	mbuf.release()
+	if ev.avoidIO {
+		// as $(error) in recipes, it fails when the command runs.
+		ev.delayedOutputs = append(ev.delayedOutputs,
+			fmt.Sprintf("echo '%s: *** %s.' 1>&2 && false", ev.srcpos, msg))
+		ev.hasIO = true
+		return nil
+	}
+	return ev.errorf("*** %s.", msg)
+}
+
 // http://www.gnu.org/software/make/manual/make.html#Foreach-Function
 type funcForeach struct{ fclosure }
 
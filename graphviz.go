@@ -0,0 +1,93 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SaveGraphviz writes nodes of g reachable from roots to w in the dot
+// language of GraphViz.  Nodes are labeled by their outputs, and phony
+// targets are boxes.  Edges to deps are solid, and edges to order-only
+// deps are dashed.  If roots is empty, all nodes of g are roots.
+func SaveGraphviz(g *DepGraph, w io.Writer, roots []string) error {
+	byOutput := make(map[string]*DepNode)
+	var stack []*DepNode
+	stack = append(stack, g.nodes...)
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, found := byOutput[node.Output]; found {
+			continue
+		}
+		byOutput[node.Output] = node
+		stack = append(stack, node.Deps...)
+		stack = append(stack, node.OrderOnlys...)
+	}
+	var queue []*DepNode
+	if len(roots) == 0 {
+		queue = append(queue, g.nodes...)
+	}
+	for _, root := range roots {
+		node, found := byOutput[root]
+		if !found {
+			return fmt.Errorf("no target %q in the graph", root)
+		}
+		queue = append(queue, node)
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph kati {")
+	seen := make(map[*DepNode]bool)
+	for _, node := range queue {
+		seen[node] = true
+	}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		attr := ""
+		if node.IsPhony {
+			attr = " [shape=box]"
+		}
+		fmt.Fprintf(bw, "  %s%s;\n", dotQuote(node.Output), attr)
+		for _, deps := range []struct {
+			nodes []*DepNode
+			attr  string
+		}{
+			{nodes: node.Deps},
+			{nodes: node.OrderOnlys, attr: " [style=dashed]"},
+		} {
+			for _, d := range deps.nodes {
+				fmt.Fprintf(bw, "  %s -> %s%s;\n", dotQuote(node.Output), dotQuote(d.Output), deps.attr)
+				if !seen[d] {
+					seen[d] = true
+					queue = append(queue, d)
+				}
+			}
+		}
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// dotQuote quotes s as an ID of the dot language.
+func dotQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
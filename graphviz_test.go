@@ -0,0 +1,75 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSaveGraphviz(t *testing.T) {
+	lib := &DepNode{Output: "lib.a"}
+	gen := &DepNode{Output: `out/"gen".h`}
+	prog := &DepNode{Output: "prog", Deps: []*DepNode{lib}, OrderOnlys: []*DepNode{gen}}
+	all := &DepNode{Output: "all", IsPhony: true, Deps: []*DepNode{prog}}
+	other := &DepNode{Output: "other", Deps: []*DepNode{lib}}
+	g := &DepGraph{nodes: []*DepNode{all, other}}
+
+	for _, tc := range []struct {
+		roots []string
+		want  string
+	}{
+		{
+			want: `digraph kati {
+  "all" [shape=box];
+  "all" -> "prog";
+  "other";
+  "other" -> "lib.a";
+  "prog";
+  "prog" -> "lib.a";
+  "prog" -> "out/\"gen\".h" [style=dashed];
+  "lib.a";
+  "out/\"gen\".h";
+}
+`,
+		},
+		{
+			roots: []string{"prog"},
+			want: `digraph kati {
+  "prog";
+  "prog" -> "lib.a";
+  "prog" -> "out/\"gen\".h" [style=dashed];
+  "lib.a";
+  "out/\"gen\".h";
+}
+`,
+		},
+	} {
+		var buf bytes.Buffer
+		err := SaveGraphviz(g, &buf, tc.roots)
+		if err != nil {
+			t.Errorf("SaveGraphviz(g, w, %q)=%v; want nil", tc.roots, err)
+			continue
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("SaveGraphviz(g, w, %q)\n got %s\nwant %s", tc.roots, got, tc.want)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := SaveGraphviz(g, &buf, []string{"nosuch"}); err == nil {
+		t.Errorf("SaveGraphviz(g, w, [nosuch])=nil; want error")
+	}
+}
@@ -15,14 +15,23 @@
 package kati
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
@@ -37,6 +46,7 @@ const (
 	nodeAlias                    // visited & alias for other target
 	nodeMissing                  // visited & no target for this output
 	nodeBuild                    // visited & build emitted
+	nodeFailed                   // visited & failed with KeepGoing
 )
 
 func (s nodeState) String() string {
@@ -53,6 +63,8 @@ func (s nodeState) String() string {
 		return "node-missing"
 	case nodeBuild:
 		return "node-build"
+	case nodeFailed:
+		return "node-failed"
 	default:
 		return fmt.Sprintf("node-unknown[%d]", int(s))
 	}
@@ -66,12 +78,188 @@ type NinjaGenerator struct {
 	Suffix string
 	// GomaDir is goma directory.  If empty, goma will not be used.
 	GomaDir string
+	// LinkPoolDepth is the depth of link_pool, used for link and
+	// archive commands.  If zero, link_pool is not used.
+	LinkPoolDepth int
+	// GomaccPath is the gomacc command.  If empty, gomacc in GomaDir
+	// is used.
+	GomaccPath string
+	// GomaJobs is the number of parallel jobs of ninja with goma.
+	// If zero, 500 is used.
+	GomaJobs int
+	// LocalPoolDepth is the depth of local_pool, used for commands
+	// which don't run with goma.  If zero, the number of CPUs is used.
+	LocalPoolDepth int
 	// DetectAndroidEcho detects echo as description.
 	DetectAndroidEcho bool
+	// EnvAllow is glob patterns of environment variables to be tracked.
+	// If empty, all used environment variables are tracked.
+	EnvAllow []string
+	// EnvIgnore is glob patterns of environment variables not to be
+	// tracked, such as volatile SSH_AUTH_SOCK.  It is applied after
+	// EnvAllow.
+	EnvIgnore []string
+	// EnvJSONPath is a filename to write used environment variables
+	// and their values as JSON.  If empty, it is not written.
+	EnvJSONPath string
+	// RegenIgnoreDirs is glob patterns of directories scanned by
+	// $(wildcard) which don't trigger regeneration of ninja files.
+	RegenIgnoreDirs []string
+	// Shortcuts emits phony targets named by basenames of outputs
+	// in subdirectories, so "ninja foo" builds "out/dir/foo".
+	Shortcuts bool
+	// NinjaVersion is the version of ninja the generated file is for,
+	// e.g. "1.7".  If empty, only features of old ninja are used.
+	// If 1.3 or later, depfiles of gcc are given to ninja without a
+	// copy, so ninja removes them after reading.
+	NinjaVersion string
+	// CompilerWrapper rewrites a command of a recipe, e.g. to run a
+	// compiler with distcc.  It returns the rewritten command and
+	// whether it recognized cmd as a compile command.  If nil, goma
+	// is used when GomaDir is set.  It is called concurrently.
+	CompilerWrapper func(cmd string) (string, bool)
+	// MaxCommands is the number of commands in a recipe to warn
+	// about.  If zero, it is not checked.
+	MaxCommands int
+	// HoistInputs emits phony targets for large input lists shared
+	// by build statements, to make the ninja file smaller.
+	HoistInputs bool
+	// MaxRuleNameLen is the maximum length of rule names.  If set,
+	// rule names are "r" followed by a base 36 number.
+	MaxRuleNameLen int
+	// NormalizeDepfileFlag adds -MF to compile commands with -MD but
+	// without -MF, instead of copying their depfiles.
+	NormalizeDepfileFlag bool
+	// RecipeWrapper is a command line to run every recipe with,
+	// e.g. []string{"kati_sandbox", "--"}.  The shell that runs the
+	// recipe is passed to it as arguments.
+	RecipeWrapper []string
+	// PolicyPath is a JSON file which maps glob patterns of outputs to
+	// ninja attributes, e.g.
+	//   [{"glob": "out/*.o", "restat": true, "pool": "cc_pool", "deps": "gcc"}]
+	// The first entry matching an output is used.  .KATI_NINJA_POOL
+	// of the target overrides the pool of the policy.
+	PolicyPath string
+	// StrictDefaultTarget makes it an error that the default target
+	// has no build statement, instead of a warning.
+	StrictDefaultTarget bool
+	// NonGCCDepfileTools is glob patterns of basenames of commands
+	// which write depfiles not in the format of gcc.  Their depfiles
+	// are given to ninja without "deps = gcc", so ninja reads them
+	// as is instead of its deps log.
+	NonGCCDepfileTools []string
+	// LastDepfileWins takes the last -MF of a compile command as its
+	// depfile, as gcc does, instead of an error.
+	LastDepfileWins bool
+	// AllowDupBuild makes outputs built by multiple rules a warning
+	// instead of an error, and only the first rule is used.
+	AllowDupBuild bool
+	// ExpandResponseFiles reads @file arguments of commands to find
+	// -MF and -o in them.  The files are read when the ninja file is
+	// generated, and the commands are not changed.
+	ExpandResponseFiles bool
+	// GenAll emits the whole graph even if targets are given to Save.
+	// Otherwise, only the targets and their deps are emitted.
+	GenAll bool
+	// GenAllTargets emits every node of the graph as GenAll does.
+	// With LoadReq.AllTargets, the graph also has explicit targets
+	// unreachable from the requested ones, so ninja can build any of
+	// them without regeneration.
+	GenAllTargets bool
+	// Emitted is the sorted outputs of build statements in the ninja
+	// files, including implicit outputs.  It is set by Save.
+	Emitted []string
+	// OmitHeader omits the version of kati from the ninja file and
+	// the shell script, so they are reproducible by another kati.
+	OmitHeader bool
+	// CategorizeDescriptions makes the default description of a
+	// command of a known tool "[CC] $out", "[CXX] $out", "[LD] $out",
+	// "[AR] $out" or "[AS] $out".
+	CategorizeDescriptions bool
+	// DescriptionUseBasename makes $out in descriptions the basename
+	// of the output, e.g. "build foo.o" instead of "build out/foo.o".
+	DescriptionUseBasename bool
+	// ShowCommands omits descriptions of rules for recipes, so ninja
+	// shows their commands.  DetectAndroidEcho is ignored.
+	ShowCommands bool
+	// GomaCompileRE matches compile commands to run with gomacc, after
+	// ccache is removed.  If nil, compile commands with compilers in
+	// prebuilts/gcc or prebuilts/clang are matched.
+	GomaCompileRE *regexp.Regexp
+	// EmitMakefileWrapper writes Makefile with Suffix, which runs
+	// the shell script for any target, for users who run make.  An
+	// existing file not written by kati is not overwritten.
+	EmitMakefileWrapper bool
+	// CommandHook rewrites the command of a build statement, e.g. to
+	// make paths of tools relative.  node is the target of the
+	// recipe, and cmd is the command after goma is applied, escaped
+	// for ninja.  It runs once per build statement, maybe
+	// concurrently, and must be deterministic for reproducible ninja
+	// files.
+	CommandHook func(node *DepNode, cmd string) string
+	// CollapsePhonyChains emits a phony target without commands which
+	// only depends on another such target as an alias of the last
+	// target of the chain, so ninja doesn't walk the chain.
+	CollapsePhonyChains bool
+	// KeepGoing emits a build statement which fails for a node whose
+	// build statement can't be emitted, and continues.  Save writes
+	// the ninja file, and returns an error of all such nodes.
+	KeepGoing bool
+	// ErrorOnMissingInput makes it an error that a prerequisite is
+	// neither an existing file nor a target of any rule, so typos in
+	// prerequisites are found when the ninja file is generated.
+	ErrorOnMissingInput bool
+	// Progress is called with the number of emitted top-level nodes
+	// and the number of all of them, every progressInterval nodes and
+	// at the end.  It may be nil.
+	Progress func(done, total int)
+	// OutDir is the directory to write the ninja files, the shell
+	// script and the env list in, which is created if needed.  If
+	// empty, the current directory is used.  Paths in the ninja files
+	// are still relative to the current directory, where the shell
+	// script runs ninja.  The Makefile wrapper is written in the
+	// current directory.
+	OutDir string
+	// RspfileForLinks puts commands to link or archive in rspfiles
+	// even if they are short, so they are easy to debug and their
+	// rules don't change as they grow.  Commands with newlines are
+	// kept inline.
+	RspfileForLinks bool
+	// EmitProvenance emits where the rule of each build statement is
+	// defined in makefiles, e.g. "# defined at foo.mk:12", above the
+	// rule.
+	EmitProvenance bool
 
-	f       *os.File
-	nodes   []*DepNode
-	exports map[string]bool
+	f           io.Writer
+	nodes       []*DepNode
+	exports     map[string]bool
+	accessedMks []*accessedMakefile
+	globDirs    []string
+	oneShell    bool
+	// deleteOnError makes commands remove their outputs on errors,
+	// as ninja doesn't remove outputs of failed commands.
+	deleteOnError bool
+	// pkgs is ninja fragments for each .KATI_PACKAGE.
+	pkgs map[string]*bytes.Buffer
+	// tmpFiles is temporary copies of depfiles made by kati.
+	tmpFiles []string
+	// commands is commands of nodes computed in parallel before
+	// emitting nodes.
+	commands map[*DepNode]*ninjaCommand
+	// hoistedInputs is phony targets for inputs of nodes.
+	hoistedInputs map[*DepNode]string
+	// policy is loaded from PolicyPath.
+	policy []ninjaPolicy
+	// builds is nodes of build statements by normalized outputs.
+	builds map[string]*DepNode
+	// alwaysBuild is set if a build statement depends on
+	// alwaysBuildTarget.
+	alwaysBuild bool
+	// nodeErrs is errors of nodes ignored by KeepGoing.
+	nodeErrs nodeErrors
+	// cancel is the context of SaveContext, checked while emitting
+	// nodes.
+	cancel context.Context
 
 	ctx *execContext
 
@@ -83,27 +271,119 @@ func (n *NinjaGenerator) init(g *DepGraph) {
 	g.resolveVPATH()
 	n.nodes = g.nodes
 	n.exports = g.exports
+	n.accessedMks = g.accessedMks
+	n.globDirs = g.globDirs
+	n.oneShell = g.oneShell
+	n.deleteOnError = g.deleteOnError
 	n.ctx = newExecContext(g.vars, g.vpaths, true)
 	n.done = make(map[string]nodeState)
+	n.pkgs = make(map[string]*bytes.Buffer)
+	n.commands = make(map[*DepNode]*ninjaCommand)
+	n.hoistedInputs = make(map[*DepNode]string)
+	n.builds = make(map[string]*DepNode)
+	n.Emitted = nil
+	n.alwaysBuild = false
+	n.nodeErrs = nil
+	n.cancel = context.Background()
 }
 
-func getDepfileImpl(ss string) (string, error) {
+// ninjaAtLeast reports whether NinjaVersion is major.minor or later.
+func (n *NinjaGenerator) ninjaAtLeast(major, minor int) bool {
+	if n.NinjaVersion == "" {
+		return false
+	}
+	vs := strings.SplitN(n.NinjaVersion, ".", 3)
+	var v [2]int
+	for i := 0; i < len(vs) && i < 2; i++ {
+		x, err := strconv.Atoi(vs[i])
+		if err != nil {
+			glog.Warningf("bad ninja version %q: %v", n.NinjaVersion, err)
+			return false
+		}
+		v[i] = x
+	}
+	if v[0] != major {
+		return v[0] > major
+	}
+	return v[1] >= minor
+}
+
+// stripDepTargetFlags removes -MT and -MQ, and their arguments, from
+// ss.  They set the target in a depfile, and their arguments, which
+// may be quoted, shouldn't be taken as -MF or -o.
+func stripDepTargetFlags(ss string) string {
+	for _, flag := range []string{" -MT ", " -MQ "} {
+		for {
+			i := strings.Index(ss, flag)
+			if i < 0 {
+				break
+			}
+			rest := trimLeftSpace(ss[i+len(flag):])
+			_, n := shellWord(rest)
+			ss = ss[:i] + rest[n:]
+		}
+	}
+	return ss
+}
+
+// depfileOpts is options to find a depfile.
+type depfileOpts struct {
+	// copyDepfile makes a command copy gcc's depfile for ninja.
+	copyDepfile bool
+	// lastMF takes the last -MF as gcc does, instead of an error.
+	lastMF bool
+	// expandRsp reads @file arguments as their contents.
+	expandRsp bool
+}
+
+// expandResponseFiles replaces @file arguments in ss with the contents
+// of the files, if they are readable now.  Response files in response
+// files are not expanded.
+func expandResponseFiles(ss string) string {
+	if !strings.Contains(ss, " @") {
+		return ss
+	}
+	var buf bytes.Buffer
+	for {
+		i := strings.Index(ss, " @")
+		if i < 0 {
+			buf.WriteString(ss)
+			return buf.String()
+		}
+		buf.WriteString(ss[:i+1])
+		ss = ss[i+2:]
+		name, n := shellWord(ss)
+		b, err := ioutil.ReadFile(name)
+		if name == "" || err != nil {
+			glog.V(1).Infof("response file %q: %v", name, err)
+			buf.WriteByte('@')
+			continue
+		}
+		buf.WriteString(strings.Join(strings.Fields(string(b)), " "))
+		ss = ss[n:]
+	}
+}
+
+func getDepfileImpl(ss string, opts depfileOpts) (string, error) {
+	if opts.expandRsp {
+		ss = expandResponseFiles(ss)
+	}
+	ss = stripDepTargetFlags(ss)
 	tss := ss + " "
 	if (!strings.Contains(tss, " -MD ") && !strings.Contains(tss, " -MMD ")) || !strings.Contains(tss, " -c ") {
 		return "", nil
 	}
 
 	mfIndex := strings.Index(ss, " -MF ")
+	if opts.lastMF {
+		mfIndex = strings.LastIndex(ss, " -MF ")
+	}
 	if mfIndex >= 0 {
-		mf := trimLeftSpace(ss[mfIndex+4:])
-		if strings.Index(mf, " -MF ") >= 0 {
+		rest := trimLeftSpace(ss[mfIndex+4:])
+		mf, n := shellWord(rest)
+		if strings.Index(rest[n:], " -MF ") >= 0 {
 			return "", fmt.Errorf("Multiple output file candidates in %s", ss)
 		}
-		mfEndIndex := strings.IndexAny(mf, " \t\n")
-		if mfEndIndex >= 0 {
-			mf = mf[:mfEndIndex]
-		}
-
 		return mf, nil
 	}
 
@@ -111,25 +391,94 @@ func getDepfileImpl(ss string) (string, error) {
 	if outIndex < 0 {
 		return "", fmt.Errorf("Cannot find the depfile in %s", ss)
 	}
-	out := trimLeftSpace(ss[outIndex+4:])
-	if strings.Index(out, " -o ") >= 0 {
+	rest := trimLeftSpace(ss[outIndex+4:])
+	out, n := shellWord(rest)
+	if strings.Index(rest[n:], " -o ") >= 0 {
 		return "", fmt.Errorf("Multiple output file candidates in %s", ss)
 	}
-	outEndIndex := strings.IndexAny(out, " \t\n")
-	if outEndIndex >= 0 {
-		out = out[:outEndIndex]
-	}
 	return stripExt(out) + ".d", nil
 }
 
+// sideOutputFlags is flags of compile commands with which compilers
+// write files next to objects, and extensions of the files.
+var sideOutputFlags = []struct {
+	flag string
+	ext  string
+}{
+	{flag: "-gsplit-dwarf", ext: ".dwo"},
+	{flag: "--coverage", ext: ".gcno"},
+	{flag: "-ftest-coverage", ext: ".gcno"},
+}
+
+// addSideOutputs adds files written next to objects by compile
+// commands in ss, which is escaped for ninja, to implicitOutputs of
+// output.  The objects are given by -o.
+func addSideOutputs(output string, implicitOutputs []string, ss string) []string {
+	added := false
+	for _, c := range strings.FieldsFunc(ss, func(r rune) bool { return r == ';' || r == '&' || r == '|' }) {
+		tss := c + " "
+		if !strings.Contains(tss, " -c ") {
+			continue
+		}
+		i := strings.Index(tss, " -o ")
+		if i < 0 {
+			continue
+		}
+		obj, _ := shellWord(trimLeftSpace(tss[i+4:]))
+		obj = strings.TrimRight(strings.Replace(obj, "$$", "$", -1), ")")
+		if obj == "" {
+			continue
+		}
+		for _, f := range sideOutputFlags {
+			if !strings.Contains(tss, " "+f.flag+" ") {
+				continue
+			}
+			o := stripExt(obj) + f.ext
+			if o == output || contains(implicitOutputs, o) {
+				continue
+			}
+			if !added {
+				// don't modify implicit outputs of the node.
+				implicitOutputs = append([]string(nil), implicitOutputs...)
+				added = true
+			}
+			implicitOutputs = append(implicitOutputs, o)
+		}
+	}
+	return implicitOutputs
+}
+
 // getDepfile gets depfile from cmdline, and returns cmdline and depfile.
 func getDepfile(cmdline string) (string, string, error) {
+	return findDepfile(cmdline, depfileOpts{copyDepfile: true})
+}
+
+// GetDepfile returns cmd rewritten for ninja, and the depfile of cmd
+// which ninja should read, or "" if cmd is not a compile command which
+// writes a depfile.  cmd is an expanded command of a recipe.  It
+// returns an error if the depfile of cmd is ambiguous.  As in ninja
+// files made by kati,
+//   - a depfile moved by automake's "mv -f" is copied instead,
+//   - Android's .P file is used instead of the removed .d file,
+//   - no depfile is used for .s files compiled by gcc, which ignores
+//     -MF for them, and
+//   - otherwise, cmd copies the depfile to a .tmp file, which is
+//     returned, since ninja removes depfiles after reading them.
+func GetDepfile(cmd string) (string, string, error) {
+	return getDepfile(cmd)
+}
+
+// findDepfile is getDepfile with opts.  If opts.copyDepfile is true,
+// a gcc's depfile is copied by cmdline, and the copy is returned as the
+// depfile, since ninja removes a depfile after it reads the depfile
+// into .ninja_deps.
+func findDepfile(cmdline string, opts depfileOpts) (string, string, error) {
 	// A hack for Android - llvm-rs-cc seems not to emit a dep file.
 	if strings.Contains(cmdline, "bin/llvm-rs-cc ") {
 		return cmdline, "", nil
 	}
 
-	depfile, err := getDepfileImpl(cmdline)
+	depfile, err := getDepfileImpl(cmdline, opts)
 	if depfile == "" || err != nil {
 		return cmdline, depfile, err
 	}
@@ -158,17 +507,108 @@ func getDepfile(cmdline string) (string, string, error) {
 	}
 
 	// A hack for Android. For .s files, GCC does not use
-	// C preprocessor, so it ignores -MF flag.
+	// C preprocessor, so it ignores -MF flag.  clang doesn't.
 	as := "/" + stripExt(filepath.Base(depfile)) + ".s"
-	if strings.Contains(cmdline, as) {
+	if i := strings.LastIndex(cmdline, as); i >= 0 && isGCCDriver(cmdline[:i]) {
 		return cmdline, "", nil
 	}
 
-	cmdline += fmt.Sprintf(" && cp %s %s.tmp", depfile, depfile)
+	if !opts.copyDepfile {
+		return cmdline, depfile, nil
+	}
+	cmdline += fmt.Sprintf(" && cp %s %s", shellQuote(depfile), shellQuote(depfile+".tmp"))
 	depfile += ".tmp"
 	return cmdline, depfile, nil
 }
 
+// normalizeDepfileFlag adds -MF to a compile command with -MD or -MMD
+// but without -MF, so ninja reads the depfile without a copy of it
+// made by getDepfile.  It returns false if cmdline is not a single
+// compile command which can be safely rewritten.
+func normalizeDepfileFlag(cmdline string) (string, string, bool) {
+	_, depfile, err := getDepfile(cmdline)
+	if err != nil || !strings.HasSuffix(depfile, ".tmp") {
+		return cmdline, "", false
+	}
+	if strings.ContainsAny(cmdline, ";&|()`\n") {
+		return cmdline, "", false
+	}
+	tss := cmdline + " "
+	if strings.Contains(tss, " -MF ") || strings.Count(tss, " -c ") != 1 || strings.Count(tss, " -o ") != 1 {
+		return cmdline, "", false
+	}
+	md := " -MD "
+	if !strings.Contains(tss, md) {
+		md = " -MMD "
+	}
+	if strings.Count(tss, " -MD ")+strings.Count(tss, " -MMD ") != 1 {
+		return cmdline, "", false
+	}
+	out, _ := shellWord(trimLeftSpace(tss[strings.Index(tss, " -o ")+4:]))
+	if out == "" {
+		return cmdline, "", false
+	}
+	i := strings.Index(tss, md) + len(md) - 1
+	depfile = out + ".d"
+	return cmdline[:i] + " -MF " + shellQuote(depfile) + cmdline[i:], depfile, true
+}
+
+// getDepfile is getDepfile with options of n.
+func (n *NinjaGenerator) getDepfile(cmdline string) (string, string, error) {
+	if n.NormalizeDepfileFlag {
+		if ncmdline, depfile, ok := normalizeDepfileFlag(cmdline); ok {
+			return ncmdline, depfile, nil
+		}
+	}
+	// ninja 1.3 or later, which has deps = gcc, reads a depfile
+	// as soon as the command finishes, so it needn't be kept.
+	return findDepfile(cmdline, depfileOpts{
+		copyDepfile: !n.ninjaAtLeast(1, 3),
+		lastMF:      n.LastDepfileWins,
+		expandRsp:   n.ExpandResponseFiles,
+	})
+}
+
+// writesNonGCCDepfile reports whether a command in cmdline which
+// mentions depfile is matched by NonGCCDepfileTools.
+func (n *NinjaGenerator) writesNonGCCDepfile(cmdline, depfile string) bool {
+	if len(n.NonGCCDepfileTools) == 0 {
+		return false
+	}
+	depfile = strings.TrimSuffix(depfile, ".tmp")
+	for _, seg := range strings.FieldsFunc(cmdline, func(r rune) bool {
+		return strings.ContainsRune(";&|", r)
+	}) {
+		ws := strings.Fields(strings.TrimLeft(seg, " \t("))
+		if len(ws) == 0 || !strings.Contains(seg, depfile) {
+			continue
+		}
+		if matchAnyGlob(n.NonGCCDepfileTools, filepath.Base(ws[0])) {
+			return true
+		}
+	}
+	return false
+}
+
+// isGCCDriver reports whether the last command in cmdline runs GCC.
+func isGCCDriver(cmdline string) bool {
+	if i := strings.LastIndexAny(cmdline, ";&|"); i >= 0 {
+		cmdline = cmdline[i+1:]
+	}
+	ws := strings.Fields(strings.TrimLeft(cmdline, " \t("))
+	for len(ws) > 0 && strings.HasSuffix(ws[0], "ccache") {
+		ws = ws[1:]
+	}
+	if len(ws) == 0 {
+		return false
+	}
+	driver := filepath.Base(ws[0])
+	if strings.Contains(driver, "clang") {
+		return false
+	}
+	return strings.HasSuffix(driver, "gcc") || strings.HasSuffix(driver, "g++") || driver == "cc" || driver == "c++"
+}
+
 func trimTailingSlash(s string) string {
 	if s == "" {
 		return s
@@ -184,6 +624,17 @@ func trimTailingSlash(s string) string {
 	return s
 }
 
+// StripShellComment removes shell comments from cmd, a command of a
+// recipe, as kati does before it emits the command to ninja files.
+func StripShellComment(cmd string) string {
+	return stripShellComment(cmd)
+}
+
+// stripShellComment removes shell comments from s.  A backslash-newline,
+// and a tab after it, which make removes, is a continuation, so a '#'
+// after it starts a comment only if the character before the backslash
+// is a whitespace.  Comments must be stripped before continuations are
+// joined, since a comment ends at a newline even after a backslash.
 func stripShellComment(s string) string {
 	if strings.IndexByte(s, '#') < 0 {
 		// Fast path.
@@ -192,6 +643,9 @@ func stripShellComment(s string) string {
 	// set space as an initial value so the leading comment will be
 	// stripped out.
 	lastch := rune(' ')
+	// beforeEscape is lastch before a backslash.
+	var beforeEscape rune
+	var continued bool
 	var escape bool
 	var quote rune
 	var skip rune
@@ -230,10 +684,24 @@ Loop:
 				cmdsubst = append(cmdsubst, '`')
 			}
 		}
+		if continued {
+			continued = false
+			if c == '\t' {
+				buf.WriteRune(c)
+				continue Loop
+			}
+		}
 		if escape {
 			escape = false
+			if c == '\n' {
+				continued = true
+				lastch = beforeEscape
+				buf.WriteRune(c)
+				continue Loop
+			}
 		} else if c == '\\' {
 			escape = true
+			beforeEscape = lastch
 		} else {
 			escape = false
 		}
@@ -243,18 +711,186 @@ Loop:
 	return buf.String()
 }
 
-var ccRE = regexp.MustCompile(`^prebuilts/(gcc|clang)/.*(gcc|g\+\+|clang|clang\+\+) .* ?-c `)
+// ccRE matches compile commands whose driver, the first word, is gcc,
+// g++, clang or clang++ in prebuilts, maybe with a target prefix such
+// as arm-linux-androideabi-.
+var ccRE = regexp.MustCompile(`^prebuilts/(gcc|clang)/[^ ]*/([^/ ]*-)?(gcc|g\+\+|clang|clang\+\+) (.* )?-c `)
 
 func gomaCmdForAndroidCompileCmd(cmd string) (string, bool) {
-	i := strings.Index(cmd, " ")
-	if i < 0 {
+	cmd = stripCcache(cmd)
+	return cmd, ccRE.MatchString(cmd)
+}
+
+// gomaCmd is gomaCmdForAndroidCompileCmd with GomaCompileRE.
+func (n *NinjaGenerator) gomaCmd(cmd string) (string, bool) {
+	if n.GomaCompileRE == nil {
+		return gomaCmdForAndroidCompileCmd(cmd)
+	}
+	cmd = stripCcache(cmd)
+	return cmd, n.GomaCompileRE.MatchString(cmd)
+}
+
+// stripCcache removes a leading ccache or sccache from cmd, with its
+// options and environment variables set for it.  A compiler in a
+// directory of ccache's symlinks, e.g. /usr/lib/ccache/clang, becomes
+// the basename.  cmd is returned as is if it doesn't run ccache.
+func stripCcache(cmd string) string {
+	s := cmd
+	word := func() (string, string) {
+		s = trimLeftSpace(s)
+		i := strings.IndexAny(s, " \t")
+		if i < 0 {
+			return s, ""
+		}
+		return s[:i], s[i:]
+	}
+	w, rest := word()
+	for isEnvAssignment(w) {
+		s = rest
+		w, rest = word()
+	}
+	switch {
+	case strings.HasSuffix(w, "ccache"):
+		s = rest
+		w, rest = word()
+		for strings.HasPrefix(w, "-") {
+			s = rest
+			w, rest = word()
+		}
+		return s
+	case filepath.Base(filepath.Dir(w)) == "ccache":
+		return filepath.Base(w) + rest
+	}
+	return cmd
+}
+
+// splitEnvPrefix splits cmd into "env" and NAME=value assignments
+// leading cmd, and the rest, which is the command run with them.
+// Options of env are not supported, and then cmd is not split.
+func splitEnvPrefix(cmd string) (string, string) {
+	s := trimLeftSpace(cmd)
+	w, n := shellWord(s)
+	if filepath.Base(w) == "env" && n == len(w) {
+		s = trimLeftSpace(s[n:])
+		w, n = shellWord(s)
+		if strings.HasPrefix(w, "-") {
+			return "", cmd
+		}
+	}
+	for isEnvAssignment(w) && n < len(s) {
+		s = trimLeftSpace(s[n:])
+		w, n = shellWord(s)
+	}
+	return cmd[:len(cmd)-len(s)], s
+}
+
+// isEnvAssignment reports whether w is NAME=value, which sets an
+// environment variable for a command.
+func isEnvAssignment(w string) bool {
+	i := strings.IndexByte(w, '=')
+	if i <= 0 {
+		return false
+	}
+	for j, c := range w[:i] {
+		if c != '_' && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && (j == 0 || !(c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// DistccCompilerWrapper is a CompilerWrapper which runs android
+// compile commands with distcc.
+func DistccCompilerWrapper(cmd string) (string, bool) {
+	rcmd, ok := gomaCmdForAndroidCompileCmd(cmd)
+	if !ok {
 		return cmd, false
 	}
-	driver := cmd[:i]
-	if strings.HasSuffix(driver, "ccache") {
-		return gomaCmdForAndroidCompileCmd(cmd[i+1:])
+	return "distcc " + rcmd, true
+}
+
+// isLinkCmd reports whether cmd has a command to link or archive,
+// which may use lots of memory.
+func isLinkCmd(cmd string) bool {
+	for _, c := range strings.FieldsFunc(cmd, func(r rune) bool { return r == ';' || r == '&' || r == '|' }) {
+		ws := strings.Fields(strings.TrimLeft(c, " \t("))
+		for len(ws) > 0 && strings.HasSuffix(ws[0], "ccache") {
+			ws = ws[1:]
+		}
+		if len(ws) < 2 {
+			continue
+		}
+		driver := filepath.Base(ws[0])
+		if driver == "ld" || strings.HasSuffix(driver, "-ld") || strings.HasPrefix(driver, "ld.") {
+			return true
+		}
+		if driver == "ar" || strings.HasSuffix(driver, "-ar") {
+			return true
+		}
+		if !ccDriverRE.MatchString(driver) {
+			continue
+		}
+		for i, w := range ws[1:] {
+			if w == "-shared" {
+				return true
+			}
+			if w == "-o" && i+2 < len(ws) && strings.HasSuffix(strings.TrimRight(ws[i+2], ")"), ".so") {
+				return true
+			}
+		}
 	}
-	return cmd, ccRE.MatchString(cmd)
+	return false
+}
+
+var ccDriverRE = regexp.MustCompile(`(gcc|g\+\+|clang|clang\+\+|^cc|^c\+\+)$`)
+
+// toolCategory returns the category of the first command of a known
+// tool in cmd, i.e. "CC", "CXX", "LD", "AR" or "AS", or "" if none.
+func toolCategory(cmd string) string {
+	for _, c := range strings.FieldsFunc(cmd, func(r rune) bool { return r == ';' || r == '&' || r == '|' }) {
+		ws := strings.Fields(strings.TrimLeft(c, " \t("))
+		for len(ws) > 0 && (strings.HasSuffix(ws[0], "ccache") || filepath.Base(ws[0]) == "env" || isEnvAssignment(ws[0])) {
+			ws = ws[1:]
+		}
+		if len(ws) < 2 {
+			continue
+		}
+		driver := filepath.Base(ws[0])
+		switch {
+		case driver == "ld" || strings.HasSuffix(driver, "-ld") || strings.HasPrefix(driver, "ld."):
+			return "LD"
+		case driver == "ar" || strings.HasSuffix(driver, "-ar"):
+			return "AR"
+		case driver == "as" || strings.HasSuffix(driver, "-as"):
+			return "AS"
+		case !ccDriverRE.MatchString(driver):
+			continue
+		}
+		compile := false
+		category := "CC"
+		if strings.HasSuffix(driver, "++") {
+			category = "CXX"
+		}
+		for _, w := range ws[1:] {
+			w = strings.TrimRight(w, ")")
+			switch {
+			case w == "-c":
+				compile = true
+			case strings.HasPrefix(w, "-"):
+			case strings.HasSuffix(w, ".s") || strings.HasSuffix(w, ".S"):
+				category = "AS"
+			case strings.HasSuffix(w, ".cc") || strings.HasSuffix(w, ".cpp") || strings.HasSuffix(w, ".cxx") || strings.HasSuffix(w, ".C"):
+				if category != "AS" {
+					category = "CXX"
+				}
+			}
+		}
+		if !compile {
+			return "LD"
+		}
+		return category
+	}
+	return ""
 }
 
 func descriptionFromCmd(cmd string) (string, bool) {
@@ -298,37 +934,90 @@ func descriptionFromCmd(cmd string) (string, bool) {
 	return buf.String(), true
 }
 
+// DetectGoma returns the directory of gomacc to use as GomaDir, or ""
+// if goma is not available.  $GOMA_DIR is used if it has gomacc, and
+// then gomacc is looked for in $PATH.
+func DetectGoma() string {
+	if dir := os.Getenv("GOMA_DIR"); dir != "" {
+		if st, err := os.Stat(filepath.Join(dir, "gomacc")); err == nil && !st.IsDir() {
+			return dir
+		}
+	}
+	gomacc, err := exec.LookPath("gomacc")
+	if err != nil {
+		return ""
+	}
+	return filepath.Dir(gomacc)
+}
+
+func (n *NinjaGenerator) gomacc() string {
+	if n.GomaccPath != "" {
+		return n.GomaccPath
+	}
+	return fmt.Sprintf("%s/gomacc", n.GomaDir)
+}
+
 func (n *NinjaGenerator) genShellScript(runners []runner) (cmd string, desc string, useLocalPool bool) {
 	const defaultDesc = "build $out"
 	var useGomacc bool
+	var category string
 	var buf bytes.Buffer
+	size := 0
+	for _, r := range runners {
+		size += len(r.cmd) + len(" && ()")
+	}
+	buf.Grow(size)
 	for i, r := range runners {
 		if i > 0 {
-			if runners[i-1].ignoreError {
+			if n.oneShell {
+				// lines of a recipe run in a shell, as a script.
+				buf.WriteString("\n")
+			} else if runners[i-1].ignoreError {
 				buf.WriteString(" ; ")
 			} else {
 				buf.WriteString(" && ")
 			}
 		}
 		cmd := trimTailingSlash(r.cmd)
+		// comments are stripped before continuations are joined.
 		cmd = stripShellComment(cmd)
 		cmd = trimLeftSpace(cmd)
-		cmd = strings.Replace(cmd, "\\\n\t", "", -1)
-		cmd = strings.Replace(cmd, "\\\n", "", -1)
+		if strings.Contains(cmd, "\\\n") {
+			if hasHeredoc(cmd) {
+				// make passes backslash-newlines to the shell,
+				// removing only tabs after them.  A heredoc
+				// needs them as is.
+				cmd = strings.Replace(cmd, "\\\n\t", "\\\n", -1)
+			} else {
+				cmd = strings.Replace(cmd, "\\\n\t", "", -1)
+				cmd = strings.Replace(cmd, "\\\n", "", -1)
+			}
+		}
 		cmd = strings.TrimRight(cmd, " \t\n;")
 		cmd = escapeNinja(cmd)
 		if cmd == "" {
 			cmd = "true"
 		}
 		glog.V(2).Infof("cmd %q=>%q", r.cmd, cmd)
-		if n.GomaDir != "" {
-			rcmd, ok := gomaCmdForAndroidCompileCmd(cmd)
+		if n.CategorizeDescriptions && category == "" {
+			category = toolCategory(cmd)
+		}
+		// env FOO=bar is kept for the wrapped compiler.
+		env, ccmd := splitEnvPrefix(cmd)
+		if n.CompilerWrapper != nil {
+			rcmd, ok := n.CompilerWrapper(ccmd)
+			if ok {
+				cmd = env + rcmd
+				useGomacc = true
+			}
+		} else if n.GomaDir != "" {
+			rcmd, ok := n.gomaCmd(ccmd)
 			if ok {
-				cmd = fmt.Sprintf("%s/gomacc %s", n.GomaDir, rcmd)
+				cmd = fmt.Sprintf("%s%s %s", env, n.gomacc(), rcmd)
 				useGomacc = true
 			}
 		}
-		if n.DetectAndroidEcho && desc == "" {
+		if n.DetectAndroidEcho && !n.ShowCommands && desc == "" {
 			d, ok := descriptionFromCmd(cmd)
 			if ok {
 				desc = d
@@ -336,7 +1025,7 @@ func (n *NinjaGenerator) genShellScript(runners []runner) (cmd string, desc stri
 			}
 		}
 		needsSubShell := i > 0 || len(runners) > 1
-		if cmd[0] == '(' {
+		if isSubShell(cmd) || n.oneShell {
 			needsSubShell = false
 		}
 
@@ -344,27 +1033,141 @@ func (n *NinjaGenerator) genShellScript(runners []runner) (cmd string, desc stri
 			buf.WriteByte('(')
 		}
 		buf.WriteString(cmd)
-		if i == len(runners)-1 && r.ignoreError {
+		if i == len(runners)-1 && !n.oneShell && r.ignoreError {
 			buf.WriteString(" ; true")
 		}
 		if needsSubShell {
 			buf.WriteByte(')')
 		}
 	}
+	if n.oneShell && runners[0].ignoreError {
+		// the prefix of the first line is for the whole recipe.
+		buf.WriteString("\ntrue")
+	}
+	if desc == "" && category != "" {
+		desc = "[" + category + "] $out"
+	}
 	if desc == "" {
 		desc = defaultDesc
 	}
 	return buf.String(), desc, n.GomaDir != "" && !useGomacc
 }
 
-func (n *NinjaGenerator) genRuleName() string {
+// isSubShell reports whether cmd is a single command in parentheses,
+// e.g. not "(foo) | bar".
+func isSubShell(cmd string) bool {
+	if cmd == "" || cmd[0] != '(' {
+		return false
+	}
+	depth := 0
+	var quote byte
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '\\':
+			i++
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return i == len(cmd)-1
+			}
+		}
+	}
+	return false
+}
+
+// deleteOnErrorCmd returns cmdline, which is escaped for ninja, to
+// remove outputs if it fails, for .DELETE_ON_ERROR.  The exit status
+// of cmdline is kept.
+func deleteOnErrorCmd(cmdline string, outputs []string) string {
+	var rm bytes.Buffer
+	for _, o := range outputs {
+		rm.WriteString(" ")
+		rm.WriteString(escapeNinja(shellQuote(o)))
+	}
+	return fmt.Sprintf("(%s) || { st=$$?; rm -f%s; exit $$st; }", cmdline, rm.String())
+}
+
+// rspShellFlags returns flags, i.e. .SHELLFLAGS, for a shell to run
+// a script in a file, i.e. without -c, with a leading space if any.
+// "-ec" becomes " -e".
+func rspShellFlags(flags string) string {
+	ws := strings.Fields(flags)
+	if len(ws) > 0 {
+		last := ws[len(ws)-1]
+		if last == "-c" {
+			ws = ws[:len(ws)-1]
+		} else if strings.HasPrefix(last, "-") && strings.HasSuffix(last, "c") {
+			ws[len(ws)-1] = strings.TrimSuffix(last, "c")
+		}
+	}
+	if len(ws) == 0 {
+		return ""
+	}
+	return " " + escapeNinja(strings.Join(ws, " "))
+}
+
+// hasHeredoc reports whether cmd has a heredoc, i.e. << not quoted.
+// <<< is a here string, not a heredoc.
+func hasHeredoc(cmd string) bool {
+	var quote byte
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '\\':
+			i++
+		case c == '\'' || c == '"':
+			quote = c
+		case strings.HasPrefix(cmd[i:], "<<<"):
+			i += 2
+		case strings.HasPrefix(cmd[i:], "<<"):
+			return true
+		}
+	}
+	return false
+}
+
+func (n *NinjaGenerator) genRuleName() (string, error) {
 	ruleName := fmt.Sprintf("rule%d", n.ruleID)
+	if n.MaxRuleNameLen > 0 {
+		// shorter, but still unique names.
+		ruleName = "r" + strconv.FormatInt(int64(n.ruleID), 36)
+		if len(ruleName) > n.MaxRuleNameLen {
+			return "", fmt.Errorf("too many rules for rule names of %d characters", n.MaxRuleNameLen)
+		}
+	}
 	n.ruleID++
-	return ruleName
+	return ruleName, nil
 }
 
-func (n *NinjaGenerator) emitBuild(output, rule, inputs, orderOnlys string) {
-	fmt.Fprintf(n.f, "build %s: %s", escapeBuildTarget(output), rule)
+func (n *NinjaGenerator) emitBuild(output string, implicitOutputs []string, rule, inputs, orderOnlys string) {
+	n.Emitted = append(n.Emitted, output)
+	n.Emitted = append(n.Emitted, implicitOutputs...)
+	fmt.Fprintf(n.f, "build %s", escapeBuildTarget(output))
+	if len(implicitOutputs) > 0 {
+		// implicit outputs need ninja 1.7.
+		fmt.Fprintf(n.f, " |")
+		for _, o := range implicitOutputs {
+			fmt.Fprintf(n.f, " %s", escapeBuildTarget(o))
+		}
+	}
+	fmt.Fprintf(n.f, ": %s", rule)
 	if inputs != "" {
 		fmt.Fprintf(n.f, " %s", inputs)
 	}
@@ -373,6 +1176,17 @@ func (n *NinjaGenerator) emitBuild(output, rule, inputs, orderOnlys string) {
 	}
 }
 
+// checkBuildTarget returns an error if s can't be a path in ninja.
+// ninja has no escape for newlines in paths.  Note '#' and tabs need
+// no escape, as ninja treats '#' as a comment only at the beginning of
+// a line.
+func checkBuildTarget(s string) error {
+	if strings.ContainsAny(s, "\r\n") {
+		return fmt.Errorf("target %q contains a newline, which ninja can't handle", s)
+	}
+	return nil
+}
+
 func escapeBuildTarget(s string) string {
 	i := strings.IndexAny(s, "$: \\")
 	if i < 0 {
@@ -403,6 +1217,11 @@ func escapeBuildTarget(s string) string {
 	return buf.String()
 }
 
+// dependency returns inputs and order-only inputs of node's build
+// statement, without duplicates.  As in GNU make, a target which is
+// both a normal and an order-only prerequisite of node is a normal one,
+// regardless of the order they are listed in.  It only depends on
+// node itself, so other build statements don't affect it.
 func (n *NinjaGenerator) dependency(node *DepNode) (string, string) {
 	var deps []string
 	seen := make(map[string]bool)
@@ -414,6 +1233,7 @@ func (n *NinjaGenerator) dependency(node *DepNode) (string, string) {
 		deps = append(deps, t)
 		seen[t] = true
 	}
+	// seen has all normal deps here, so they are never order-only.
 	var orderOnlys []string
 	for _, d := range node.OrderOnlys {
 		t := escapeBuildTarget(d.Output)
@@ -430,8 +1250,53 @@ func escapeNinja(s string) string {
 	return strings.Replace(s, "$", "$$", -1)
 }
 
+// replaceNinjaOut replaces references to $out in s, which is escaped
+// for ninja, with value.
+func replaceNinjaOut(s, value string) string {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			buf.WriteByte(s[i])
+			continue
+		}
+		rest := s[i+1:]
+		switch {
+		case rest[0] == '$':
+			buf.WriteString("$$")
+			i++
+		case strings.HasPrefix(rest, "{out}"):
+			buf.WriteString(value)
+			i += len("{out}")
+		case strings.HasPrefix(rest, "out") && (len(rest) == 3 || !isNinjaVarChar(rest[3])):
+			buf.WriteString(value)
+			i += len("out")
+		default:
+			buf.WriteByte('$')
+		}
+	}
+	return buf.String()
+}
+
+// isNinjaVarChar reports whether c may be in a name of a ninja
+// variable referred by $name.
+func isNinjaVarChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// shellNewlineVar is set to a newline by the shell which runs
+// "$shell -c ...", so a recipe may have newlines in the double-quoted
+// command line, which can't have literal newlines in ninja.
+const shellNewlineVar = "kati_nl=$$(printf '\\n.') && kati_nl=$${kati_nl%.} && "
+
+// escapeShell escapes s to be in a double-quoted command line.
+// Newlines become ${kati_nl} (see shellNewlineVar).  Tabs are kept
+// as is.  "!" is not escaped since history expansion is off in the
+// non-interactive shell, which would keep the backslash.
 func escapeShell(s string) string {
-	i := strings.IndexAny(s, "$`!\\\"")
+	i := strings.IndexAny(s, "$`\\\"\n")
 	if i < 0 {
 		return s
 	}
@@ -448,8 +1313,12 @@ func escapeShell(s string) string {
 			buf.WriteString(`\$`)
 			lastDollar = true
 			continue
-		case '`', '"', '!', '\\':
+		case '`', '"', '\\':
 			buf.WriteByte('\\')
+		case '\n':
+			buf.WriteString("$${kati_nl}")
+			lastDollar = false
+			continue
 		}
 		buf.WriteRune(c)
 		lastDollar = false
@@ -457,7 +1326,38 @@ func escapeShell(s string) string {
 	return buf.String()
 }
 
+// canSingleQuote reports whether cmdline, which is escaped for ninja,
+// is better in single quotes than in double quotes.  It is if it has
+// characters escapeShell would escape, but no single quotes nor
+// newlines, which can't be in single quotes.
+func canSingleQuote(cmdline string) bool {
+	return strings.ContainsAny(cmdline, "$`\\\"") && !strings.ContainsAny(cmdline, "'\n")
+}
+
+// byValueLen sorts pairs of a value and its variable by descending
+// length of the value.
+type byValueLen [][]string
+
+func (b byValueLen) Len() int           { return len(b) }
+func (b byValueLen) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byValueLen) Less(i, j int) bool { return len(b[i][0]) > len(b[j][0]) }
+
+// ninjaVarsBoundary is bytes which may separate a path from the rest
+// of a shell command.
+const ninjaVarsBoundary = " \t\n;&|()<>"
+
+// ninjaVars replaces values of nv in s with their ninja variables,
+// e.g. the inputs with ${in}, and then escapes s with esc if not nil.
+// Only the values which are whole words outside of quotes are
+// replaced (a value may follow "="), so a path in a quoted message is
+// kept as is.  Automatic variables such as $< are expanded when the
+// ninja file is generated, and ninja can't refer to a single input in
+// $in, so $< becomes ${in} only when it is the only input.  Otherwise,
+// the path of the first prerequisite is in the command as is.  Longer
+// values are tried first, so a value which is a prefix of another,
+// e.g. ${out} "foo" and ${in} "foobar", doesn't break it.
 func (n *NinjaGenerator) ninjaVars(s string, nv [][]string, esc func(string) string) string {
+	var pairs [][]string
 	for _, v := range nv {
 		k, v := v[0], v[1]
 		if v == "" {
@@ -468,65 +1368,774 @@ func (n *NinjaGenerator) ninjaVars(s string, nv [][]string, esc func(string) str
 			// ninja will emit quoted string for $
 			continue
 		}
-		if esc != nil {
-			v = esc(v)
-		}
-		s = strings.Replace(s, v, k, -1)
+		pairs = append(pairs, []string{v, k})
 	}
-	return s
-}
+	sort.Stable(byValueLen(pairs))
 
-func (n *NinjaGenerator) emitNode(node *DepNode) error {
-	output := node.Output
-	if _, found := n.done[output]; found {
-		return nil
+	// replaced values are marked by NUL, which can't be in a shell
+	// command, and become variables after s is escaped.
+	var buf bytes.Buffer
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			}
+		case c == '\\' && i+1 < len(s):
+			buf.WriteByte(c)
+			i++
+			c = s[i]
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case i == 0 || strings.IndexByte(ninjaVarsBoundary+"=", s[i-1]) >= 0:
+			if j := matchNinjaVar(s[i:], pairs); j >= 0 {
+				fmt.Fprintf(&buf, "\x00%d\x00", j)
+				i += len(pairs[j][0]) - 1
+				continue
+			}
+		}
+		buf.WriteByte(c)
 	}
-	n.done[output] = nodeVisit
+	s = buf.String()
+	if esc != nil {
+		s = esc(s)
+	}
+	if len(pairs) == 0 {
+		return s
+	}
+	var oldnew []string
+	for j, p := range pairs {
+		oldnew = append(oldnew, fmt.Sprintf("\x00%d\x00", j), p[1])
+	}
+	return strings.NewReplacer(oldnew...).Replace(s)
+}
 
-	if len(node.Cmds) == 0 && len(node.Deps) == 0 && len(node.OrderOnlys) == 0 && !node.IsPhony {
-		if _, ok := n.ctx.vpaths.exists(output); ok {
-			n.done[output] = nodeFile
-			return nil
-		}
-		o := filepath.Clean(output)
-		if o != output {
-			// if normalized target has been done, it marks as alias.
-			if s, found := n.done[o]; found {
-				glog.V(1).Infof("node %s=%s => %s=alias", o, s, node.Output)
-				n.done[output] = nodeAlias
-				return nil
-			}
+// matchNinjaVar returns the index of the first pair whose value is the
+// word at the beginning of s, or -1.
+func matchNinjaVar(s string, pairs [][]string) int {
+	for j, p := range pairs {
+		v := p[0]
+		if !strings.HasPrefix(s, v) {
+			continue
 		}
-		if node.Filename == "" {
-			n.done[output] = nodeMissing
+		if len(s) == len(v) || strings.IndexByte(ninjaVarsBoundary, s[len(v)]) >= 0 {
+			return j
 		}
-		return nil
 	}
+	return -1
+}
+
+// recipeWrapper returns RecipeWrapper as a prefix of ninja's command.
+// Each argument is quoted for the shell and escaped for ninja.
+func (n *NinjaGenerator) recipeWrapper() string {
+	var buf bytes.Buffer
+	for _, arg := range n.RecipeWrapper {
+		buf.WriteString(escapeNinja(shellQuote(arg)))
+		buf.WriteByte(' ')
+	}
+	return buf.String()
+}
 
-	runners, _, err := createRunners(n.ctx, node)
+// ninjaCommand is a shell script for a node.
+type ninjaCommand struct {
+	hasRunners   bool
+	numRunners   int
+	script       string
+	desc         string
+	useLocalPool bool
+	err          error
+}
+
+func (n *NinjaGenerator) newNinjaCommand(ctx *execContext, node *DepNode) *ninjaCommand {
+	runners, _, err := createRunners(ctx, node)
 	if err != nil {
-		return err
+		return &ninjaCommand{err: nodeError(node, err)}
 	}
-	ruleName := "phony"
+	if len(runners) == 0 {
+		return &ninjaCommand{}
+	}
+	ss, desc, ulp := n.genShellScript(runners)
+	if n.CommandHook != nil {
+		ss = n.CommandHook(node, ss)
+	}
+	return &ninjaCommand{
+		hasRunners:   true,
+		numRunners:   len(runners),
+		script:       ss,
+		desc:         desc,
+		useLocalPool: ulp,
+	}
+}
+
+// nodeError annotates err with the target of node and where its
+// recipe is defined, so users can find it in makefiles.  The position
+// of an EvalError is kept, as it is more precise.
+func nodeError(node *DepNode, err error) error {
+	if e, ok := err.(EvalError); ok {
+		e.Err = fmt.Errorf("recipe for %q: %v", node.Output, e.Err)
+		return e
+	}
+	err = fmt.Errorf("recipe for %q: %v", node.Output, err)
+	if node.Filename == "" {
+		return err
+	}
+	return srcpos{node.Filename, node.Lineno}.error(err)
+}
+
+// checkCycles returns an error if there is a dependency cycle in
+// nodes, which ninja can't build.
+func checkCycles(nodes []*DepNode) error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	type frame struct {
+		node *DepNode
+		i    int
+	}
+	state := make(map[string]int)
+	var stack []frame
+	for _, root := range nodes {
+		if state[root.Output] != 0 {
+			continue
+		}
+		state[root.Output] = visiting
+		stack = append(stack, frame{node: root})
+		for len(stack) > 0 {
+			f := &stack[len(stack)-1]
+			deps := f.node.Deps
+			i := f.i
+			if i >= len(deps) {
+				deps = f.node.OrderOnlys
+				i -= len(f.node.Deps)
+			}
+			if i >= len(deps) {
+				state[f.node.Output] = visited
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			f.i++
+			d := deps[i]
+			switch state[d.Output] {
+			case visiting:
+				var cycle []string
+				for j := len(stack) - 1; j >= 0; j-- {
+					if stack[j].node.Output == d.Output {
+						for _, f := range stack[j:] {
+							cycle = append(cycle, f.node.Output)
+						}
+						break
+					}
+				}
+				cycle = append(cycle, d.Output)
+				return fmt.Errorf("*** dependency cycle: %s", strings.Join(cycle, " -> "))
+			case visited:
+				continue
+			}
+			state[d.Output] = visiting
+			stack = append(stack, frame{node: d})
+		}
+	}
+	return nil
+}
+
+// hasNotParallel reports whether a node with commands is to be built
+// serially by .NOTPARALLEL.
+func (n *NinjaGenerator) hasNotParallel() bool {
+	for _, node := range n.allNodes() {
+		if node.NotParallel && len(node.Cmds) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// allNodes returns all nodes reachable from n.nodes, in depth first
+// order.
+func (n *NinjaGenerator) allNodes() []*DepNode {
+	var nodes []*DepNode
+	seen := make(map[*DepNode]bool)
+	var stack []*DepNode
+	push := func(ns []*DepNode) {
+		for i := len(ns) - 1; i >= 0; i-- {
+			stack = append(stack, ns[i])
+		}
+	}
+	push(n.nodes)
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		nodes = append(nodes, node)
+		push(node.OrderOnlys)
+		push(node.Deps)
+	}
+	return nodes
+}
+
+// hoistInputsMinLen is the minimum length of input lists to be hoisted.
+const hoistInputsMinLen = 1024
+
+// emitHoistedInputs emits phony targets for large input lists shared
+// by multiple build statements, and makes the build statements depend
+// on them instead.  A ninja variable can't be used for them, as ninja
+// doesn't split the value of a variable into paths.  Input lists used
+// by commands (i.e. $in) are not hoisted, as $in would be the phony.
+func (n *NinjaGenerator) emitHoistedInputs() {
+	type inputList struct {
+		inputs string
+		nodes  []*DepNode
+	}
+	var lists []*inputList
+	byInputs := make(map[string]*inputList)
+	for _, node := range n.allNodes() {
+		inputs, _ := n.dependency(node)
+		if len(inputs) < hoistInputsMinLen {
+			continue
+		}
+		if len(node.Cmds) > 0 {
+			cmd, ok := n.commands[node]
+			if !ok {
+				cmd = n.newNinjaCommand(n.ctx, node)
+				n.commands[node] = cmd
+			}
+			if strings.Contains(cmd.script, inputs) {
+				continue
+			}
+		}
+		l, ok := byInputs[inputs]
+		if !ok {
+			l = &inputList{inputs: inputs}
+			byInputs[inputs] = l
+			lists = append(lists, l)
+		}
+		l.nodes = append(l.nodes, node)
+	}
+	for _, l := range lists {
+		if len(l.nodes) < 2 {
+			continue
+		}
+		name := fmt.Sprintf("kati_inputs%d", len(n.hoistedInputs))
+		for {
+			if _, found := n.done[name]; !found {
+				break
+			}
+			name += "_"
+		}
+		n.emitBuild(name, nil, "phony", l.inputs, "")
+		fmt.Fprintf(n.f, "\n")
+		n.done[name] = nodeBuild
+		for _, node := range l.nodes {
+			n.hoistedInputs[node] = name
+		}
+	}
+}
+
+// prepareCommands computes commands of all nodes in parallel, with
+// an exec context for each worker, since createRunners of a context
+// is serialized.  Nodes are emitted in the same order as before.
+//
+// Each worker has its own copy of variables, so side effects of
+// $(eval ...) in a recipe wouldn't reach later recipes.  If any recipe
+// may call eval, commands are computed serially while emitting nodes
+// instead.  Unless KeepGoing is set, no more commands are computed
+// after an error, and the rest are computed while emitting nodes if
+// they are reached.
+func (n *NinjaGenerator) prepareCommands() {
+	var nodes []*DepNode
+	evalVars := make(map[string]bool)
+	for _, node := range n.allNodes() {
+		if len(node.Cmds) == 0 {
+			continue
+		}
+		if n.nodeUsesEval(node, evalVars) {
+			glog.V(1).Infof("recipe for %q may use eval; commands are computed serially", node.Output)
+			return
+		}
+		nodes = append(nodes, node)
+	}
+
+	numWorkers := runtime.GOMAXPROCS(0)
+	if numWorkers > len(nodes) {
+		numWorkers = len(nodes)
+	}
+	if numWorkers <= 1 {
+		return
+	}
+	commands := make([]*ninjaCommand, len(nodes))
+	nodeChan := make(chan int)
+	var failed int32
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		ctx := newExecContext(NewVars(n.ctx.ev.vars), n.ctx.vpaths, true)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range nodeChan {
+				cmd := n.newNinjaCommand(ctx, nodes[i])
+				if cmd.err != nil && !n.KeepGoing {
+					atomic.StoreInt32(&failed, 1)
+				}
+				commands[i] = cmd
+			}
+		}()
+	}
+	for i := range nodes {
+		if atomic.LoadInt32(&failed) != 0 || n.cancel.Err() != nil {
+			break
+		}
+		nodeChan <- i
+	}
+	close(nodeChan)
+	wg.Wait()
+	for i, node := range nodes {
+		if commands[i] != nil {
+			n.commands[node] = commands[i]
+		}
+	}
+}
+
+// nodeUsesEval reports whether recipes of node may call the eval
+// function, directly or in variables they refer to.  evalVars caches
+// the result for global variables.
+func (n *NinjaGenerator) nodeUsesEval(node *DepNode, evalVars map[string]bool) bool {
+	for _, v := range node.TargetSpecificVars {
+		if tsv, ok := v.(*targetSpecificVar); ok {
+			v = tsv.v
+		}
+		if rv, ok := v.(*recursiveVar); ok && n.valueUsesEval(rv.expr, evalVars) {
+			return true
+		}
+	}
+	for _, cmd := range node.Cmds {
+		if strings.IndexByte(cmd, '$') < 0 {
+			continue
+		}
+		v, _, err := parseExpr([]byte(cmd), nil, parseOp{})
+		if err != nil {
+			// it will be reported when the recipe is evaluated.
+			continue
+		}
+		if n.valueUsesEval(v, evalVars) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *NinjaGenerator) valueUsesEval(v Value, evalVars map[string]bool) bool {
+	switch v := v.(type) {
+	case *funcEval, *funcEvalAssign:
+		return true
+	case expr:
+		for _, e := range v {
+			if n.valueUsesEval(e, evalVars) {
+				return true
+			}
+		}
+	case *varref:
+		switch name := v.varname.(type) {
+		case literal, tmpval:
+			return n.varUsesEval(name.String(), evalVars)
+		}
+		// a computed name is not known until the recipe is
+		// evaluated, so only the name itself is checked.
+		return n.valueUsesEval(v.varname, evalVars)
+	case *funcCall:
+		// the first argument is the name of the called variable.
+		if len(v.args) > 1 {
+			switch name := v.args[1].(type) {
+			case literal, tmpval:
+				if n.varUsesEval(strings.TrimSpace(name.String()), evalVars) {
+					return true
+				}
+			}
+		}
+		for _, e := range v.args[1:] {
+			if n.valueUsesEval(e, evalVars) {
+				return true
+			}
+		}
+	case varsubst:
+		for _, e := range []Value{v.varname, v.pat, v.subst} {
+			if n.valueUsesEval(e, evalVars) {
+				return true
+			}
+		}
+	case interface {
+		fargs() []Value
+	}:
+		for _, e := range v.fargs()[1:] {
+			if n.valueUsesEval(e, evalVars) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// varUsesEval reports whether the value of global variable name may
+// call the eval function.
+func (n *NinjaGenerator) varUsesEval(name string, evalVars map[string]bool) bool {
+	if uses, ok := evalVars[name]; ok {
+		return uses
+	}
+	// false while it is checked, for recursive references.
+	evalVars[name] = false
+	rv, ok := n.ctx.ev.vars[name].(*recursiveVar)
+	uses := ok && n.valueUsesEval(rv.expr, evalVars)
+	evalVars[name] = uses
+	return uses
+}
+
+// checkCommandCount returns a warning message if node has more than
+// MaxCommands commands, which is likely a bug of the makefile.
+func (n *NinjaGenerator) checkCommandCount(node *DepNode, count int) string {
+	if n.MaxCommands <= 0 || count <= n.MaxCommands {
+		return ""
+	}
+	return fmt.Sprintf("recipe for %q has %d commands (more than %d)", node.Output, count, n.MaxCommands)
+}
+
+// ninjaPolicy is ninja attributes for outputs matching Glob.
+type ninjaPolicy struct {
+	Glob   string `json:"glob"`
+	Restat bool   `json:"restat"`
+	Pool   string `json:"pool"`
+	// Deps is the deps mode, "gcc" or "msvc".  If empty, "gcc" is
+	// used for commands with a depfile.
+	Deps string `json:"deps"`
+}
+
+// loadNinjaPolicy reads a policy file written as a JSON array.
+func loadNinjaPolicy(filename string) ([]ninjaPolicy, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	var policy []ninjaPolicy
+	err = d.Decode(&policy)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	for _, p := range policy {
+		if _, err := filepath.Match(p.Glob, ""); err != nil {
+			return nil, fmt.Errorf("%s: bad glob %q: %v", filename, p.Glob, err)
+		}
+		switch p.Deps {
+		case "", "gcc", "msvc":
+		default:
+			return nil, fmt.Errorf("%s: unknown deps mode %q for %q", filename, p.Deps, p.Glob)
+		}
+	}
+	return policy, nil
+}
+
+// policyFor returns the first policy matching output.
+func (n *NinjaGenerator) policyFor(output string) ninjaPolicy {
+	for _, p := range n.policy {
+		if ok, _ := filepath.Match(p.Glob, output); ok {
+			return p
+		}
+	}
+	return ninjaPolicy{}
+}
+
+// emitNode emits node and all nodes reachable from it.  It uses an
+// explicit stack rather than recursion, so that very deep dependency
+// chains don't exhaust the goroutine stack.  Nodes are emitted in the
+// same order as a recursive walk would: node, its deps, then its
+// order-only deps.
+func (n *NinjaGenerator) emitNode(root *DepNode) error {
+	type frame struct {
+		node *DepNode
+		// f is the writer of the nearest ancestor with a package, so
+		// untagged nodes first needed by a package go to its fragment.
+		f io.Writer
+		// parent is the node which needs node, or nil for root.
+		parent *DepNode
+	}
+	f := n.f
+	defer func() {
+		n.f = f
+	}()
+	stack := []frame{{node: root, f: f}}
+	for len(stack) > 0 {
+		if err := n.cancel.Err(); err != nil {
+			return err
+		}
+		fr := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		n.f = fr.f
+		var children []*DepNode
+		var err error
+		if n.KeepGoing {
+			children, err = n.emitNodeKeepGoing(fr.node, fr.parent)
+		} else {
+			children, err = n.emitNodeOne(fr.node, fr.parent)
+		}
+		if err != nil {
+			return err
+		}
+		for i := len(children) - 1; i >= 0; i-- {
+			stack = append(stack, frame{node: children[i], f: n.f, parent: fr.node})
+		}
+	}
+	return nil
+}
+
+// emitNodeKeepGoing is emitNodeOne for KeepGoing.  If node can't be
+// emitted, what is written for it is discarded, and a build statement
+// which fails with the error is emitted instead.  No build statement
+// is emitted if node's output can't be a ninja target.
+func (n *NinjaGenerator) emitNodeKeepGoing(node, parent *DepNode) ([]*DepNode, error) {
+	w := n.f
+	pkgLens := make(map[string]int)
+	for pkg, b := range n.pkgs {
+		pkgLens[pkg] = b.Len()
+	}
+	numEmitted := len(n.Emitted)
+	numTmpFiles := len(n.tmpFiles)
+	alwaysBuild := n.alwaysBuild
+	ruleID := n.ruleID
+	state, visited := n.done[node.Output]
+	var buf bytes.Buffer
+	n.f = &buf
+	children, err := n.emitNodeOne(node, parent)
+	if err == nil {
+		w.Write(buf.Bytes())
+		if n.f == &buf {
+			n.f = w
+		}
+		return children, nil
+	}
+	for pkg, b := range n.pkgs {
+		l, found := pkgLens[pkg]
+		if !found {
+			delete(n.pkgs, pkg)
+			continue
+		}
+		b.Truncate(l)
+	}
+	n.Emitted = n.Emitted[:numEmitted]
+	n.tmpFiles = n.tmpFiles[:numTmpFiles]
+	n.alwaysBuild = alwaysBuild
+	n.ruleID = ruleID
+	// node may be visited before the error, and then a phony target
+	// would be emitted for it, maybe as a duplicate of another build
+	// statement.
+	if visited {
+		n.done[node.Output] = state
+	} else {
+		n.done[node.Output] = nodeFailed
+	}
+	for o, b := range n.builds {
+		if b == node {
+			delete(n.builds, o)
+		}
+	}
+	n.f = w
+	n.nodeErrs = append(n.nodeErrs, err)
+	if checkBuildTarget(node.Output) != nil {
+		return nodeChildren(node), nil
+	}
+	if dup, err := n.checkDupBuild(node, []string{node.Output}); dup || err != nil {
+		return nodeChildren(node), nil
+	}
+	msg := strings.Replace(err.Error(), "\n", " ", -1)
+	fmt.Fprintf(n.f, "\n")
+	n.emitBuild(node.Output, nil, keepGoingErrorRule, "", "")
+	fmt.Fprintf(n.f, "\n msg = %s\n", escapeNinja(shellQuote("kati: "+msg)))
+	n.done[node.Output] = nodeBuild
+	return nodeChildren(node), nil
+}
+
+// keepGoingErrorRule is the rule of build statements which fail for
+// nodes ignored by KeepGoing.
+const keepGoingErrorRule = "kati_error"
+
+// nodeErrors is errors of nodes ignored by KeepGoing.
+type nodeErrors []error
+
+func (e nodeErrors) Error() string {
+	var msgs []string
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d node(s) failed:\n%s", len(e), strings.Join(msgs, "\n"))
+}
+
+// emitNodeOne emits node itself, and returns its deps and order-only
+// deps to be emitted next.  n.f is left as the writer for node's
+// package, if any.  parent is the node which needs node, or nil.
+func (n *NinjaGenerator) emitNodeOne(node, parent *DepNode) ([]*DepNode, error) {
+	output := node.Output
+	if _, found := n.done[output]; found {
+		// output may be built by another node, e.g. as its implicit
+		// output, and then node's recipe would be lost.
+		if len(node.Cmds) > 0 {
+			_, err := n.checkDupBuild(node, []string{output})
+			return nil, err
+		}
+		return nil, nil
+	}
+	n.done[output] = nodeVisit
+
+	if len(node.Cmds) == 0 && len(node.Deps) == 0 && len(node.OrderOnlys) == 0 && !node.IsPhony {
+		if _, ok := n.ctx.vpaths.exists(output); ok {
+			n.done[output] = nodeFile
+			return nil, nil
+		}
+		o := filepath.Clean(output)
+		if o != output {
+			// if normalized target has been done, it marks as alias.
+			if s, found := n.done[o]; found {
+				glog.V(1).Infof("node %s=%s => %s=alias", o, s, node.Output)
+				n.done[output] = nodeAlias
+				return nil, nil
+			}
+		}
+		if n.ErrorOnMissingInput && parent != nil && node.Filename == "" {
+			err := fmt.Errorf("*** No rule to make target %q, needed by %q.", output, parent.Output)
+			if parent.Filename == "" {
+				return nil, err
+			}
+			return nil, srcpos{parent.Filename, parent.Lineno}.error(err)
+		}
+		if node.Filename == "" {
+			n.done[output] = nodeMissing
+		}
+		return nil, nil
+	}
+
+	cmd, ok := n.commands[node]
+	if !ok {
+		cmd = n.newNinjaCommand(n.ctx, node)
+	}
+	if cmd.err != nil {
+		return nil, cmd.err
+	}
+	nodeImplicitOutputs := node.ImplicitOutputs
+	if cmd.hasRunners {
+		nodeImplicitOutputs = addSideOutputs(output, nodeImplicitOutputs, cmd.script)
+	}
+
+	for _, o := range append([]string{output}, nodeImplicitOutputs...) {
+		err := checkBuildTarget(o)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, deps := range [][]*DepNode{node.Deps, node.OrderOnlys} {
+		for _, d := range deps {
+			err := checkBuildTarget(d.Output)
+			if err != nil {
+				return nil, fmt.Errorf("%v (needed by %q)", err, output)
+			}
+		}
+	}
+	if msg := n.checkCommandCount(node, cmd.numRunners); msg != "" {
+		warn(srcpos{node.Filename, node.Lineno}, "%s", msg)
+	}
+	dup, err := n.checkDupBuild(node, append([]string{output}, nodeImplicitOutputs...))
+	if err != nil {
+		return nil, err
+	}
+	if dup {
+		n.done[output] = nodeBuild
+		return nodeChildren(node), nil
+	}
+	if node.Package != "" {
+		if err := checkPackageName(node.Package); err != nil {
+			return nil, nodeError(node, err)
+		}
+		// build statements and their rules are in the fragment of
+		// the package, as well as untagged nodes first needed by it.
+		n.f = n.packageWriter(node.Package)
+	}
+	ruleName := "phony"
 	useLocalPool := false
+	useLinkPool := false
+	policy := n.policyFor(output)
+	pool := node.Pool
+	if pool == "" {
+		pool = policy.Pool
+	}
+	if pool == "" && node.NotParallel && cmd.hasRunners {
+		pool = "serial_pool"
+	}
 	inputs, orderOnlys := n.dependency(node)
-	if len(runners) > 0 {
-		ruleName = n.genRuleName()
+	if n.CollapsePhonyChains && !cmd.hasRunners && isPassThrough(node) {
+		inputs = escapeBuildTarget(passThroughTarget(node).Output)
+	}
+	if cmd.hasRunners {
+		ruleName, err = n.genRuleName()
+		if err != nil {
+			return nil, err
+		}
 		fmt.Fprintf(n.f, "\n# rule for %q\n", node.Output)
+		if n.EmitProvenance && node.Filename != "" {
+			fmt.Fprintf(n.f, "# defined at %s:%d\n", commentString(node.Filename), node.Lineno)
+		}
 		fmt.Fprintf(n.f, "rule %s\n", ruleName)
 
-		ss, desc, ulp := n.genShellScript(runners)
-		if ulp {
+		ss := cmd.script
+		if cmd.useLocalPool {
 			useLocalPool = true
 		}
-		fmt.Fprintf(n.f, " description = %s\n", desc)
-		cmdline, depfile, err := getDepfile(ss)
+		if n.LinkPoolDepth > 0 && isLinkCmd(ss) {
+			useLinkPool = true
+		}
+		if !n.ShowCommands {
+			desc := cmd.desc
+			if node.Description != "" {
+				// .KATI_DESCRIPTION is shown as is.
+				desc = escapeNinja(strings.Replace(node.Description, "\n", " ", -1))
+			}
+			if n.DescriptionUseBasename {
+				desc = replaceNinjaOut(desc, escapeNinja(filepath.Base(output)))
+			}
+			fmt.Fprintf(n.f, " description = %s\n", desc)
+		}
+		if policy.Restat {
+			fmt.Fprintf(n.f, " restat = 1\n")
+		}
+		if node.Generator {
+			// for .KATI_GENERATOR.
+			fmt.Fprintf(n.f, " generator = 1\n")
+		}
+		cmdline, depfile, err := n.getDepfile(ss)
 		if err != nil {
-			return err
+			return nil, nodeError(node, err)
 		}
-		if depfile != "" {
+		if n.deleteOnError && !node.IsPhony {
+			cmdline = deleteOnErrorCmd(cmdline, append([]string{output}, nodeImplicitOutputs...))
+		}
+		if policy.Deps == "msvc" {
+			fmt.Fprintf(n.f, " deps = msvc\n")
+		} else if depfile != "" {
+			if pool == "console" {
+				return nil, nodeError(node, fmt.Errorf("uses console pool with depfile %q", depfile))
+			}
+			if strings.HasSuffix(depfile, ".tmp") {
+				n.tmpFiles = append(n.tmpFiles, depfile)
+			}
 			fmt.Fprintf(n.f, " depfile = %s\n", depfile)
-			fmt.Fprintf(n.f, " deps = gcc\n")
+			if policy.Deps == "gcc" || !n.writesNonGCCDepfile(ss, depfile) {
+				fmt.Fprintf(n.f, " deps = gcc\n")
+			}
 		}
 		nv := [][]string{
 			[]string{"${in}", inputs},
@@ -535,39 +2144,134 @@ func (n *NinjaGenerator) emitNode(node *DepNode) error {
 		// It seems Linux is OK with ~130kB.
 		// TODO: Find this number automatically.
 		ArgLenLimit := 100 * 1000
-		if len(cmdline) > ArgLenLimit {
+		forceRsp := n.RspfileForLinks && isLinkCmd(ss) && !strings.Contains(cmdline, "\n")
+		if len(cmdline) > ArgLenLimit || forceRsp {
 			fmt.Fprintf(n.f, " rspfile = $out.rsp\n")
 			cmdline = n.ninjaVars(cmdline, nv, nil)
 			fmt.Fprintf(n.f, " rspfile_content = %s\n", cmdline)
-			fmt.Fprintf(n.f, " command = %s $out.rsp\n", n.ctx.shell)
+			fmt.Fprintf(n.f, " command = %s%s%s $out.rsp\n", n.recipeWrapper(), n.ctx.shell, rspShellFlags(n.ctx.shellFlags))
+		} else if canSingleQuote(cmdline) {
+			cmdline = n.ninjaVars(cmdline, nv, nil)
+			fmt.Fprintf(n.f, " command = %s%s %s '%s'\n", n.recipeWrapper(), n.ctx.shell, escapeNinja(n.ctx.shellFlags), cmdline)
 		} else {
-			cmdline = escapeShell(cmdline)
+			var nl string
+			if strings.Contains(cmdline, "\n") {
+				nl = shellNewlineVar
+			}
 			cmdline = n.ninjaVars(cmdline, nv, escapeShell)
-			fmt.Fprintf(n.f, " command = %s -c \"%s\"\n", n.ctx.shell, cmdline)
+			fmt.Fprintf(n.f, " command = %s%s%s %s \"%s\"\n", nl, n.recipeWrapper(), n.ctx.shell, escapeNinja(n.ctx.shellFlags), cmdline)
 		}
 	}
-	n.emitBuild(output, ruleName, inputs, orderOnlys)
-	if useLocalPool {
-		fmt.Fprintf(n.f, " pool = local_pool\n")
+	if name, ok := n.hoistedInputs[node]; ok {
+		inputs = name
+	}
+	if node.IsPhony && cmd.hasRunners {
+		// ninja skips the command if a file named output exists
+		// and is newer than inputs, but .PHONY means it always runs.
+		inputs = strings.TrimLeft(inputs+" | "+alwaysBuildTarget, " ")
+		n.alwaysBuild = true
+	}
+	var implicitOutputs []string
+	if len(nodeImplicitOutputs) > 0 && n.ninjaAtLeast(1, 7) {
+		implicitOutputs = nodeImplicitOutputs
 	}
+	n.emitBuild(output, implicitOutputs, ruleName, inputs, orderOnlys)
 	fmt.Fprintf(n.f, "\n")
+	if pool != "" {
+		fmt.Fprintf(n.f, " pool = %s\n", pool)
+	} else if useLinkPool {
+		fmt.Fprintf(n.f, " pool = link_pool\n")
+	} else if useLocalPool {
+		fmt.Fprintf(n.f, " pool = local_pool\n")
+	}
 	n.done[output] = nodeBuild
-
-	for _, d := range node.Deps {
-		err := n.emitNode(d)
-		if err != nil {
-			return err
+	if len(nodeImplicitOutputs) > 0 && implicitOutputs == nil {
+		// old ninja doesn't support implicit outputs, so make them
+		// aliases of the primary output.
+		for _, o := range nodeImplicitOutputs {
+			if _, found := n.done[o]; found {
+				continue
+			}
+			n.emitBuild(o, nil, "phony", escapeBuildTarget(output), "")
+			fmt.Fprintf(n.f, "\n")
+			n.done[o] = nodeBuild
+		}
+	} else {
+		for _, o := range implicitOutputs {
+			n.done[o] = nodeBuild
 		}
-		glog.V(1).Infof("node %s dep node %q %s", node.Output, d.Output, n.done[d.Output])
 	}
-	for _, d := range node.OrderOnlys {
-		err := n.emitNode(d)
-		if err != nil {
-			return err
+
+	return nodeChildren(node), nil
+}
+
+// nodeChildren returns deps and order-only deps of node.
+func nodeChildren(node *DepNode) []*DepNode {
+	children := make([]*DepNode, 0, len(node.Deps)+len(node.OrderOnlys))
+	children = append(children, node.Deps...)
+	children = append(children, node.OrderOnlys...)
+	return children
+}
+
+// isPassThrough reports whether node is a phony target which only
+// forwards to its single dep.
+func isPassThrough(node *DepNode) bool {
+	return node.IsPhony && len(node.Cmds) == 0 && len(node.Deps) == 1 && len(node.OrderOnlys) == 0 && len(node.ImplicitOutputs) == 0
+}
+
+// passThroughTarget returns the node which the chain of pass-through
+// deps from node ends with.
+func passThroughTarget(node *DepNode) *DepNode {
+	seen := map[*DepNode]bool{node: true}
+	t := node.Deps[0]
+	for isPassThrough(t) && !seen[t] {
+		seen[t] = true
+		t = t.Deps[0]
+	}
+	return t
+}
+
+// checkDupBuild records outputs as built by node.  If one of them is
+// already built by another node, which ninja rejects, it returns an
+// error with both rules, or warns and returns true if AllowDupBuild
+// is set.  Paths are compared as ninja normalizes them.
+func (n *NinjaGenerator) checkDupBuild(node *DepNode, outputs []string) (bool, error) {
+	for _, o := range outputs {
+		key := filepath.Clean(o)
+		prev, found := n.builds[key]
+		if !found {
+			n.builds[key] = node
+			continue
+		}
+		if prev == node {
+			continue
 		}
-		glog.V(1).Infof("node %s order node %q %s", node.Output, d.Output, n.done[d.Output])
+		err := fmt.Errorf("multiple rules generate %q: %s and %s", o, nodePos(prev), nodePos(node))
+		if !n.AllowDupBuild {
+			return false, err
+		}
+		glog.Warningf("%v; the latter is ignored", err)
+		return true, nil
 	}
-	return nil
+	return false, nil
+}
+
+// commentString returns s to be in a comment of ninja files.  It is
+// quoted if it has newlines or other characters which are not
+// printable as is.
+func commentString(s string) string {
+	if q := strconv.Quote(s); q[1:len(q)-1] != s {
+		return q
+	}
+	return s
+}
+
+// nodePos returns where the rule of node is defined.
+func nodePos(node *DepNode) string {
+	if node.Filename == "" {
+		return fmt.Sprintf("the rule of %q", node.Output)
+	}
+	return fmt.Sprintf("%s:%d", node.Filename, node.Lineno)
 }
 
 func (n *NinjaGenerator) emitRegenRules() error {
@@ -583,70 +2287,332 @@ rule regen_ninja
  description = Regenerate ninja files due to dependency
  generator=1
  command=%s
-`, strings.Join(n.Args, " "))
-	fmt.Fprintf(n.f, "build %s: regen_ninja %s", n.ninjaName(), mkfiles)
-	// TODO: Add dependencies to directories read by $(wildcard) or
-	// $(shell find).
-	if len(usedEnvs) > 0 {
+ depfile = %s
+`, n.regenCommand(), n.depfileName())
+	// Without deps = gcc, ninja reads the depfile in place every time,
+	// so a manual run of kati which rewrites it is noticed.
+	// MAKEFILE_LIST is still listed so modified makefiles are noticed
+	// even if the depfile is missing.
+	fmt.Fprintf(n.f, "build %s: regen_ninja", n.ninjaName())
+	for _, mk := range splitSpacesEscaped(mkfiles) {
+		fmt.Fprintf(n.f, " %s", escapeBuildTarget(mk))
+	}
+	n.Emitted = append(n.Emitted, n.ninjaName())
+	// TODO: Add dependencies to directories read by $(shell find).
+	if len(n.usedEnvNames()) > 0 {
 		fmt.Fprintf(n.f, " %s", n.envlistName())
 	}
+	if n.PolicyPath != "" {
+		fmt.Fprintf(n.f, " %s", escapeBuildTarget(n.PolicyPath))
+	}
+	// A new file in a globbed directory updates the mtime of the
+	// directory. They are implicit, not order-only, dependencies
+	// since order-only dependencies never trigger regeneration.
+	if dirs := n.regenDirs(); len(dirs) > 0 {
+		fmt.Fprintf(n.f, " |")
+		for _, dir := range dirs {
+			fmt.Fprintf(n.f, " %s", escapeBuildTarget(dir))
+		}
+	}
 	fmt.Fprintf(n.f, "\n\n")
 	return nil
 }
 
+// emitRegenDirs emits phony targets for globbed directories which the
+// regen rule depends on, so a removed directory regenerates ninja
+// files instead of failing as a missing input.  Directories which are
+// already targets are left as is.
+func (n *NinjaGenerator) emitRegenDirs() {
+	if len(n.Args) == 0 {
+		return
+	}
+	var dirs []string
+	for _, dir := range n.regenDirs() {
+		if n.done[dir] == nodeBuild {
+			continue
+		}
+		if _, found := n.builds[filepath.Clean(dir)]; found {
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+	if len(dirs) == 0 {
+		return
+	}
+	fmt.Fprintln(n.f)
+	for _, dir := range dirs {
+		n.emitBuild(dir, nil, "phony", "", "")
+		fmt.Fprintln(n.f)
+		n.done[dir] = nodeBuild
+	}
+}
+
+// regenCommand returns the command line to run kati with Args again.
+// Each argument is quoted for the shell and escaped for ninja.
+func (n *NinjaGenerator) regenCommand() string {
+	args := make([]string, len(n.Args))
+	for i, arg := range n.Args {
+		args[i] = escapeNinja(shellQuote(arg))
+	}
+	return strings.Join(args, " ")
+}
+
+// regenDirs returns globbed directories not matched by RegenIgnoreDirs.
+// Directories kati and ninja write files into are skipped, since their
+// mtimes change on every run and would regenerate ninja files forever.
+func (n *NinjaGenerator) regenDirs() []string {
+	outDirs := map[string]bool{
+		".":                     true,
+		filepathClean(n.OutDir): true,
+		n.packagesDir():         true,
+	}
+	var dirs []string
+	for _, dir := range n.globDirs {
+		if outDirs[filepathClean(dir)] {
+			glog.V(1).Infof("regen: skip output dir %q", dir)
+			continue
+		}
+		if matchAnyGlob(n.RegenIgnoreDirs, dir) {
+			glog.V(1).Infof("regen: ignore dir %q", dir)
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// outPath returns the path of a generated file name in OutDir.
+func (n *NinjaGenerator) outPath(name string) string {
+	return filepath.Join(n.OutDir, name)
+}
+
 func (n *NinjaGenerator) shName() string {
-	return fmt.Sprintf("ninja%s.sh", n.Suffix)
+	return n.outPath(fmt.Sprintf("ninja%s.sh", n.Suffix))
+}
+
+func (n *NinjaGenerator) makefileWrapperName() string {
+	return fmt.Sprintf("Makefile%s", n.Suffix)
 }
 
 func (n *NinjaGenerator) ninjaName() string {
-	return fmt.Sprintf("build%s.ninja", n.Suffix)
+	return n.outPath(fmt.Sprintf("build%s.ninja", n.Suffix))
 }
 
 func (n *NinjaGenerator) envlistName() string {
-	return fmt.Sprintf(".kati_env%s", n.Suffix)
+	return n.outPath(fmt.Sprintf(".kati_env%s", n.Suffix))
 }
 
-func (n *NinjaGenerator) generateEnvlist() (err error) {
-	f, err := os.Create(n.envlistName())
+func (n *NinjaGenerator) packagesDir() string {
+	return filepath.Join(n.OutDir, fmt.Sprintf("build%s.packages", n.Suffix))
+}
+
+// checkPackageName returns an error if the fragment of pkg would be
+// written outside of the packages directory.
+func checkPackageName(pkg string) error {
+	clean := filepath.Clean(pkg)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf(".KATI_PACKAGE %q is outside of the packages directory", pkg)
+	}
+	return nil
+}
+
+func (n *NinjaGenerator) packageNinjaName(pkg string) string {
+	return filepath.Join(n.packagesDir(), pkg+".ninja")
+}
+
+func (n *NinjaGenerator) packageWriter(pkg string) io.Writer {
+	w, found := n.pkgs[pkg]
+	if !found {
+		w = new(bytes.Buffer)
+		n.pkgs[pkg] = w
+	}
+	return w
+}
+
+func (n *NinjaGenerator) packageNames() []string {
+	var pkgs []string
+	for pkg := range n.pkgs {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	return pkgs
+}
+
+func (n *NinjaGenerator) generatePackages() error {
+	for _, pkg := range n.packageNames() {
+		name := n.packageNinjaName(pkg)
+		err := os.MkdirAll(filepath.Dir(name), 0755)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(name, n.pkgs[pkg].Bytes(), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *NinjaGenerator) depfileName() string {
+	return n.ninjaName() + ".d"
+}
+
+// generateRegenDepfile writes makefiles read during evaluation as
+// a depfile of the ninja file, so ninja regenerates it when any of
+// them is modified.
+func (n *NinjaGenerator) generateRegenDepfile() (err error) {
+	if len(n.Args) == 0 {
+		return nil
+	}
+	f, err := createAtomic(n.depfileName())
 	if err != nil {
 		return err
 	}
 	defer func() {
-		cerr := f.Close()
-		if err == nil {
-			err = cerr
+		err = f.finish(err)
+	}()
+	return n.emitRegenDepfile(f)
+}
+
+func (n *NinjaGenerator) emitRegenDepfile(w io.Writer) error {
+	seen := make(map[string]bool)
+	var mkfiles []string
+	for _, mk := range n.accessedMks {
+		if mk.State == fileNotExists || seen[mk.Filename] {
+			continue
+		}
+		seen[mk.Filename] = true
+		mkfiles = append(mkfiles, mk.Filename)
+	}
+	sort.Strings(mkfiles)
+	_, err := fmt.Fprintf(w, "%s:", escapeDepfile(n.ninjaName()))
+	if err != nil {
+		return err
+	}
+	for _, mk := range mkfiles {
+		_, err = fmt.Fprintf(w, " \\\n %s", escapeDepfile(mk))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintln(w)
+	return err
+}
+
+// escapeDepfile escapes s as a path in gcc depfile format.
+func escapeDepfile(s string) string {
+	if strings.IndexAny(s, " #$") < 0 {
+		return s
+	}
+	var buf bytes.Buffer
+	for _, c := range s {
+		switch c {
+		case ' ', '#':
+			buf.WriteByte('\\')
+		case '$':
+			buf.WriteByte('$')
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
+
+// usedEnvNames returns sorted names of used environment variables
+// which are tracked.  If EnvAllow is set, only names matched by it are
+// tracked, and then names matched by EnvIgnore are excluded.
+func (n *NinjaGenerator) usedEnvNames() []string {
+	var names []string
+	usedEnvsMu.Lock()
+	defer usedEnvsMu.Unlock()
+	for name := range usedEnvs {
+		if len(n.EnvAllow) > 0 && !matchAnyGlob(n.EnvAllow, name) {
+			continue
 		}
+		if matchAnyGlob(n.EnvIgnore, name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func matchAnyGlob(pats []string, s string) bool {
+	for _, pat := range pats {
+		if ok, _ := filepath.Match(pat, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *NinjaGenerator) generateEnvlist() (err error) {
+	f, err := createAtomic(n.envlistName())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = f.finish(err)
 	}()
-	for k := range usedEnvs {
+	envs := make(map[string]string)
+	for _, k := range n.usedEnvNames() {
 		v, err := n.ctx.ev.EvaluateVar(k)
 		if err != nil {
 			return err
 		}
+		envs[k] = v
 		fmt.Fprintf(f, "%q=%q\n", k, v)
 	}
+	if n.EnvJSONPath != "" {
+		return writeEnvJSON(n.EnvJSONPath, envs)
+	}
 	return nil
 }
 
+// writeEnvJSON writes envs as a JSON object from names to values.
+func writeEnvJSON(filename string, envs map[string]string) error {
+	// json.Marshal sorts map keys, so the output is stable.
+	b, err := json.MarshalIndent(envs, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	return ioutil.WriteFile(filename, b, 0644)
+}
+
 func (n *NinjaGenerator) generateShell() (err error) {
-	f, err := os.Create(n.shName())
+	f, err := createAtomic(n.shName())
 	if err != nil {
 		return err
 	}
 	defer func() {
-		cerr := f.Close()
-		if err == nil {
-			err = cerr
-		}
+		err = f.finish(err)
 	}()
 
 	fmt.Fprintf(f, "#!/bin/bash\n")
-	fmt.Fprintf(f, "# Generated by kati %s\n", gitVersion)
+	if !n.OmitHeader {
+		fmt.Fprintf(f, "# Generated by kati %s\n", gitVersion)
+	}
 	fmt.Fprintln(f)
 	fmt.Fprintln(f, `cd $(dirname "$0")`)
+	if n.OutDir != "" {
+		root, err := n.rootFromOutDir()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(f, "cd %s\n", shellQuote(root))
+	}
 	if n.Suffix != "" {
 		fmt.Fprintf(f, "if [ -f %s ]; then\n export $(cat %s)\nfi\n", n.envlistName(), n.envlistName())
 	}
-	for name, export := range n.exports {
+	var names []string
+	for name := range n.exports {
+		names = append(names, name)
+	}
+	// sorted for reproducible output.
+	sort.Strings(names)
+	for _, name := range names {
+		export := n.exports[name]
 		// export "a b"=c will error on bash
 		// bash: export `a b=c': not a valid identifier
 		if strings.ContainsAny(name, " \t\n\r") {
@@ -666,35 +2632,104 @@ func (n *NinjaGenerator) generateShell() (err error) {
 	if n.GomaDir == "" {
 		fmt.Fprintf(f, `exec ninja -f %s "$@"`+"\n", n.ninjaName())
 	} else {
-		fmt.Fprintf(f, `exec ninja -f %s -j500 "$@"`+"\n", n.ninjaName())
+		jobs := n.GomaJobs
+		if jobs <= 0 {
+			jobs = 500
+		}
+		fmt.Fprintf(f, `exec ninja -f %s -j%d "$@"`+"\n", n.ninjaName(), jobs)
 	}
 
 	return f.Chmod(0755)
 }
 
+// rootFromOutDir returns the current directory relative to OutDir.
+func (n *NinjaGenerator) rootFromOutDir() (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	out, err := filepath.Abs(n.OutDir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(out, wd)
+}
+
+// makefileWrapperMarker is the first line of the Makefile wrapper,
+// by which kati finds the wrapper is its own.
+const makefileWrapperMarker = "# Makefile wrapper generated by kati."
+
+func (n *NinjaGenerator) generateMakefileWrapper() (err error) {
+	name := n.makefileWrapperName()
+	if b, err := ioutil.ReadFile(name); err == nil && !bytes.HasPrefix(b, []byte(makefileWrapperMarker+"\n")) {
+		return fmt.Errorf("%s exists and is not generated by kati", name)
+	}
+	f, err := createAtomic(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = f.finish(err)
+	}()
+
+	sh := n.shName()
+	if !filepath.IsAbs(sh) {
+		sh = "./" + sh
+	}
+	fmt.Fprintln(f, makefileWrapperMarker)
+	fmt.Fprintf(f, "# It runs %s for any target.\n", n.shName())
+	fmt.Fprintln(f)
+	fmt.Fprintln(f, ".SUFFIXES:")
+	fmt.Fprintln(f, ".DEFAULT_GOAL := kati_default")
+	fmt.Fprintln(f, ".PHONY: kati_default")
+	fmt.Fprintf(f, "kati_default:\n\t@%s\n", sh)
+	// the empty rule keeps make from remaking this file by %.
+	fmt.Fprintf(f, "%s: ;\n", name)
+	fmt.Fprintf(f, "%%:\n\t@%s $@\n", sh)
+	return nil
+}
+
 func (n *NinjaGenerator) generateNinja(defaultTarget string) (err error) {
-	f, err := os.Create(n.ninjaName())
+	f, err := createAtomic(n.ninjaName())
 	if err != nil {
 		return err
 	}
+	w := bufio.NewWriter(f)
 	defer func() {
-		cerr := f.Close()
+		ferr := w.Flush()
 		if err == nil {
-			err = cerr
+			err = ferr
 		}
+		err = f.finish(err)
 	}()
 
-	n.f = f
-	fmt.Fprintf(n.f, "# Generated by kati %s\n", gitVersion)
-	fmt.Fprintf(n.f, "\n")
+	n.f = w
+	err = n.emitNinja(defaultTarget)
+	if err != nil {
+		return err
+	}
+	return n.generatePackages()
+}
 
-	if len(usedEnvs) > 0 {
-		fmt.Fprintln(n.f, "# Environment variables used:")
-		var names []string
-		for name := range usedEnvs {
-			names = append(names, name)
+func (n *NinjaGenerator) emitNinja(defaultTarget string) error {
+	err := checkCycles(n.nodes)
+	if err != nil {
+		return err
+	}
+	if n.PolicyPath != "" {
+		n.policy, err = loadNinjaPolicy(n.PolicyPath)
+		if err != nil {
+			return err
 		}
-		sort.Strings(names)
+	}
+
+	if !n.OmitHeader {
+		fmt.Fprintf(n.f, "# Generated by kati %s\n", gitVersion)
+		fmt.Fprintf(n.f, "\n")
+	}
+
+	if names := n.usedEnvNames(); len(names) > 0 {
+		fmt.Fprintln(n.f, "# Environment variables used:")
 		for _, name := range names {
 			v, err := n.ctx.ev.EvaluateVar(name)
 			if err != nil {
@@ -707,7 +2742,26 @@ func (n *NinjaGenerator) generateNinja(defaultTarget string) (err error) {
 
 	if n.GomaDir != "" {
 		fmt.Fprintf(n.f, "pool local_pool\n")
-		fmt.Fprintf(n.f, " depth = %d\n\n", runtime.NumCPU())
+		depth := n.LocalPoolDepth
+		if depth <= 0 {
+			depth = runtime.NumCPU()
+		}
+		fmt.Fprintf(n.f, " depth = %d\n\n", depth)
+	}
+	if n.LinkPoolDepth > 0 {
+		fmt.Fprintf(n.f, "pool link_pool\n")
+		fmt.Fprintf(n.f, " depth = %d\n\n", n.LinkPoolDepth)
+	}
+	if n.hasNotParallel() {
+		// for .NOTPARALLEL.
+		fmt.Fprintf(n.f, "pool serial_pool\n")
+		fmt.Fprintf(n.f, " depth = 1\n\n")
+	}
+
+	if n.KeepGoing {
+		fmt.Fprintf(n.f, "rule %s\n", keepGoingErrorRule)
+		fmt.Fprintf(n.f, " description = kati error for $out\n")
+		fmt.Fprintf(n.f, " command = echo $msg >&2; false\n\n")
 	}
 
 	err = n.emitRegenRules()
@@ -715,22 +2769,30 @@ func (n *NinjaGenerator) generateNinja(defaultTarget string) (err error) {
 		return err
 	}
 
+	n.prepareCommands()
+	if n.HoistInputs {
+		n.emitHoistedInputs()
+	}
 	// defining $out for $@ and $in for $^ here doesn't work well,
 	// because these texts will be processed in escapeShell...
-	for _, node := range n.nodes {
+	for i, node := range n.nodes {
 		err := n.emitNode(node)
 		if err != nil {
 			return err
 		}
 		glog.V(1).Infof("node %q %s", node.Output, n.done[node.Output])
+		if n.Progress != nil && ((i+1)%progressInterval == 0 || i+1 == len(n.nodes)) {
+			n.Progress(i+1, len(n.nodes))
+		}
 	}
 
 	// emit phony targets for visited nodes that are
 	//  - not existing file
 	//  - not alias for other targets.
+	// Targets ninja can't handle are left, as KeepGoing reported them.
 	var nodes []string
 	for node, state := range n.done {
-		if state != nodeVisit {
+		if state != nodeVisit || checkBuildTarget(node) != nil {
 			continue
 		}
 		nodes = append(nodes, node)
@@ -739,23 +2801,218 @@ func (n *NinjaGenerator) generateNinja(defaultTarget string) (err error) {
 		fmt.Fprintln(n.f)
 		sort.Strings(nodes)
 		for _, node := range nodes {
-			n.emitBuild(node, "phony", "", "")
+			n.emitBuild(node, nil, "phony", "", "")
 			fmt.Fprintln(n.f)
 			n.done[node] = nodeBuild
 		}
 	}
+	n.emitRegenDirs()
+
+	if len(n.pkgs) > 0 {
+		fmt.Fprintln(n.f)
+		for _, pkg := range n.packageNames() {
+			fmt.Fprintf(n.f, "subninja %s\n", escapeBuildTarget(n.packageNinjaName(pkg)))
+		}
+	}
+
+	if n.Shortcuts {
+		n.emitShortcuts()
+	}
+	n.emitAlwaysBuild()
+	n.emitCleanTmp()
+	sort.Strings(n.Emitted)
 
 	// emit default if the target was emitted.
 	if defaultTarget != "" && n.done[defaultTarget] == nodeBuild {
 		fmt.Fprintf(n.f, "\ndefault %s\n", escapeNinja(defaultTarget))
+	} else if msg := n.checkDefaultTarget(defaultTarget); msg != "" {
+		if n.StrictDefaultTarget {
+			return fmt.Errorf("%s", msg)
+		}
+		glog.Warningf("%s", msg)
 	}
 	return nil
 }
 
+// progressInterval is how many top-level nodes are emitted between
+// calls of Progress.
+const progressInterval = 1000
+
+// checkDefaultTarget returns a message why defaultTarget has no build
+// statement, in which case ninja has no default target.
+func (n *NinjaGenerator) checkDefaultTarget(defaultTarget string) string {
+	if defaultTarget == "" {
+		return ""
+	}
+	var why string
+	switch s := n.done[defaultTarget]; s {
+	case nodeBuild:
+		return ""
+	case nodeInit:
+		why = "it is not reachable from the targets"
+	case nodeFile:
+		why = "it is an existing file without a rule"
+	case nodeAlias:
+		why = fmt.Sprintf("it is an alias of %q", filepath.Clean(defaultTarget))
+	case nodeMissing:
+		why = "there is no rule to make it"
+	case nodeFailed:
+		why = "it has an error ignored by KeepGoing"
+	default:
+		why = fmt.Sprintf("it is %s", s)
+	}
+	return fmt.Sprintf("default target %q is not emitted: %s", defaultTarget, why)
+}
+
+// emitShortcuts emits phony targets for basenames of emitted outputs.
+// A shortcut is emitted only if its basename is not a target and maps
+// to exactly one output, so the result doesn't depend on the order of
+// nodes. Ambiguous basenames are dropped.
+func (n *NinjaGenerator) emitShortcuts() {
+	paths := make(map[string][]string)
+	for output, state := range n.done {
+		if state != nodeBuild {
+			continue
+		}
+		base := filepath.Base(output)
+		if base == output {
+			continue
+		}
+		if _, found := n.done[base]; found {
+			continue
+		}
+		paths[base] = append(paths[base], output)
+	}
+	var bases []string
+	for base := range paths {
+		bases = append(bases, base)
+	}
+	sort.Strings(bases)
+	var emitted bool
+	for _, base := range bases {
+		ps := paths[base]
+		if len(ps) > 1 {
+			sort.Strings(ps)
+			glog.V(1).Infof("shortcut %q dropped: %q", base, ps)
+			continue
+		}
+		if !emitted {
+			fmt.Fprintln(n.f)
+			emitted = true
+		}
+		n.emitBuild(base, nil, "phony", escapeBuildTarget(ps[0]), "")
+		fmt.Fprintln(n.f)
+	}
+}
+
+// alwaysBuildTarget is a phony target without inputs, which ninja
+// always considers dirty unless a file of the name exists.
+const alwaysBuildTarget = "_kati_always_build_"
+
+// emitAlwaysBuild emits alwaysBuildTarget if it is used.
+func (n *NinjaGenerator) emitAlwaysBuild() {
+	if !n.alwaysBuild {
+		return
+	}
+	if _, found := n.done[alwaysBuildTarget]; found {
+		glog.Warningf("%s is already defined. not emitted", alwaysBuildTarget)
+		return
+	}
+	fmt.Fprintln(n.f)
+	n.emitBuild(alwaysBuildTarget, nil, "phony", "", "")
+	fmt.Fprintln(n.f)
+	n.done[alwaysBuildTarget] = nodeBuild
+}
+
+// emitCleanTmp emits clean_katitmp, which removes temporary
+// files made by kati, i.e. copies of depfiles.
+func (n *NinjaGenerator) emitCleanTmp() {
+	const name = "clean_katitmp"
+	if len(n.tmpFiles) == 0 {
+		return
+	}
+	if _, found := n.done[name]; found {
+		glog.Warningf("%s is already defined. not emitted", name)
+		return
+	}
+	// The rspfile is a shell script, as ninja can't put newlines or
+	// NULs in it to separate files for xargs.
+	files := make([]string, len(n.tmpFiles))
+	for i, f := range n.tmpFiles {
+		files[i] = escapeNinja(shellQuote(f))
+	}
+	fmt.Fprintf(n.f, "\nrule %s\n", name)
+	fmt.Fprintf(n.f, " description = clean kati temporary files\n")
+	fmt.Fprintf(n.f, " rspfile = $out.rsp\n")
+	fmt.Fprintf(n.f, " rspfile_content = rm -f %s\n", strings.Join(files, " "))
+	fmt.Fprintf(n.f, " command = /bin/sh $out.rsp\n")
+	n.emitBuild(name, nil, name, "", "")
+	fmt.Fprintf(n.f, "\n")
+	n.done[name] = nodeBuild
+}
+
+// defaultTarget returns the default target of the ninja file.  If no
+// targets are given, it is the first node, which is .DEFAULT_GOAL or the
+// first target of makefiles.
+func defaultTarget(g *DepGraph, targets []string) string {
+	if len(targets) == 0 && len(g.nodes) > 0 {
+		return g.nodes[0].Output
+	}
+	return ""
+}
+
+// targetNodes returns nodes for targets, found in nodes and their deps.
+func targetNodes(nodes []*DepNode, targets []string) ([]*DepNode, error) {
+	byOutput := make(map[string]*DepNode)
+	seen := make(map[*DepNode]bool)
+	stack := append([]*DepNode(nil), nodes...)
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		if _, found := byOutput[node.Output]; !found || len(node.Cmds) > 0 {
+			byOutput[node.Output] = node
+		}
+		stack = append(stack, nodeChildren(node)...)
+	}
+	var tnodes []*DepNode
+	for _, t := range targets {
+		node, found := byOutput[t]
+		if !found {
+			return nil, fmt.Errorf("*** No rule to make target %q.", t)
+		}
+		tnodes = append(tnodes, node)
+	}
+	return tnodes, nil
+}
+
 // Save generates build.ninja from DepGraph.
 func (n *NinjaGenerator) Save(g *DepGraph, name string, targets []string) error {
+	return n.SaveContext(context.Background(), g, name, targets)
+}
+
+// SaveContext is Save which stops when ctx is done, and returns the
+// error of ctx.  The partially written ninja file is removed then.
+func (n *NinjaGenerator) SaveContext(ctx context.Context, g *DepGraph, name string, targets []string) error {
 	startTime := time.Now()
 	n.init(g)
+	n.cancel = ctx
+	if n.OutDir != "" {
+		err := os.MkdirAll(n.OutDir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	if len(targets) > 0 && !n.GenAll && !n.GenAllTargets {
+		nodes, err := targetNodes(g.nodes, targets)
+		if err != nil {
+			return err
+		}
+		n.nodes = nodes
+	}
 	err := n.generateEnvlist()
 	if err != nil {
 		return err
@@ -764,14 +3021,23 @@ func (n *NinjaGenerator) Save(g *DepGraph, name string, targets []string) error
 	if err != nil {
 		return err
 	}
-	var defaultTarget string
-	if len(targets) == 0 && len(g.nodes) > 0 {
-		defaultTarget = g.nodes[0].Output
+	if n.EmitMakefileWrapper {
+		err = n.generateMakefileWrapper()
+		if err != nil {
+			return err
+		}
 	}
-	err = n.generateNinja(defaultTarget)
+	err = n.generateRegenDepfile()
+	if err != nil {
+		return err
+	}
+	err = n.generateNinja(defaultTarget(g, targets))
 	if err != nil {
 		return err
 	}
 	logStats("generate ninja time: %q", time.Since(startTime))
+	if len(n.nodeErrs) > 0 {
+		return n.nodeErrs
+	}
 	return nil
 }
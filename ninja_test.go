@@ -14,7 +14,20 @@
 
 package kati
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+)
 
 func TestStripShellComment(t *testing.T) {
 	for _, tc := range []struct {
@@ -61,6 +74,43 @@ func TestStripShellComment(t *testing.T) {
 			in:   "foo `\\\\`# bar`",
 			want: "foo `\\\\`# bar`",
 		},
+		{
+			in:   "echo `date +%Y#%m`",
+			want: "echo `date +%Y#%m`",
+		},
+		{
+			in:   "echo `echo '# a'` \"# b\" '# c'",
+			want: "echo `echo '# a'` \"# b\" '# c'",
+		},
+		{
+			// a comment in a command substitution ends with it.
+			in:   "echo `date # now` $(date # now) done",
+			want: "echo `date ` $(date ) done",
+		},
+		{
+			in:   "# leading comment",
+			want: "",
+		},
+		{
+			// "foo # bar" for the shell.
+			in:   "foo \\\n# bar",
+			want: "foo \\\n",
+		},
+		{
+			// "foo# bar" for the shell.
+			in:   "foo\\\n# bar",
+			want: "foo\\\n# bar",
+		},
+		{
+			// make removes the tab after backslash-newline.
+			in:   "foo\\\n\t# bar",
+			want: "foo\\\n\t# bar",
+		},
+		{
+			// a comment ends at a newline even after a backslash.
+			in:   "foo # bar \\\nbaz",
+			want: "foo \nbaz",
+		},
 	} {
 		got := stripShellComment(tc.in)
 		if got != tc.want {
@@ -107,6 +157,36 @@ func TestGetDepFile(t *testing.T) {
 			cmd:     `g++ -c fat.cc -MD -o fat.o -MF foo.d && cp foo.d foo.d.tmp`,
 			depfile: `foo.d.tmp`,
 		},
+		{
+			in:      `g++ -c fat.cc -MD -MT obj.o -MF obj.d -o fat.o`,
+			cmd:     `g++ -c fat.cc -MD -MT obj.o -MF obj.d -o fat.o && cp obj.d obj.d.tmp`,
+			depfile: `obj.d.tmp`,
+		},
+		{
+			in:      `g++ -c fat.cc -MD -MQ '$(OBJ) -MF x.d -o x.o' -MT obj.o -o fat.o`,
+			cmd:     `g++ -c fat.cc -MD -MQ '$(OBJ) -MF x.d -o x.o' -MT obj.o -o fat.o && cp fat.d fat.d.tmp`,
+			depfile: `fat.d.tmp`,
+		},
+		{
+			in:      `g++ -c fat.cc -MD -MF obj.d -MT -MF -o fat.o`,
+			cmd:     `g++ -c fat.cc -MD -MF obj.d -MT -MF -o fat.o && cp obj.d obj.d.tmp`,
+			depfile: `obj.d.tmp`,
+		},
+		{
+			in:      `g++ -c fat.cc -MD -o "out dir/fat.o"`,
+			cmd:     `g++ -c fat.cc -MD -o "out dir/fat.o" && cp 'out dir/fat.d' 'out dir/fat.d.tmp'`,
+			depfile: `out dir/fat.d.tmp`,
+		},
+		{
+			in:      `g++ -c fat.cc -MD -MF 'out dir/fat.o.d' -o "out dir/fat.o"`,
+			cmd:     `g++ -c fat.cc -MD -MF 'out dir/fat.o.d' -o "out dir/fat.o" && cp 'out dir/fat.o.d' 'out dir/fat.o.d.tmp'`,
+			depfile: `out dir/fat.o.d.tmp`,
+		},
+		{
+			in:      `g++ -c fat.cc -MD -MF "a -MF b.d" -o fat.o`,
+			cmd:     `g++ -c fat.cc -MD -MF "a -MF b.d" -o fat.o && cp 'a -MF b.d' 'a -MF b.d.tmp'`,
+			depfile: `a -MF b.d.tmp`,
+		},
 		// A real example from maloader.
 		{
 			in:      `g++ -g -Iinclude -Wall -MMD -fno-omit-frame-pointer -O -m64 -W -Werror   -c -o fat.o fat.cc`,
@@ -123,6 +203,20 @@ func TestGetDepFile(t *testing.T) {
 			in:      `echo "target asm: libsonivox <= external/sonivox/arm-wt-22k/lib_src/ARM-E_filter_gnu.s" && mkdir -p out/target/product/generic/obj/SHARED_LIBRARIES/libsonivox_intermediates/lib_src/ && prebuilts/gcc/linux-x86/arm/arm-linux-androideabi-4.9/bin/arm-linux-androideabi-gcc -I external/sonivox/arm-wt-22k/host_src -I external/sonivox/arm-wt-22k/lib_src -I external/libcxx/include -I external/sonivox/arm-wt-22k -I out/target/product/generic/obj/SHARED_LIBRARIES/libsonivox_intermediates -I out/target/product/generic/gen/SHARED_LIBRARIES/libsonivox_intermediates -I libnativehelper/include/nativehelper $$(cat out/target/product/generic/obj/SHARED_LIBRARIES/libsonivox_intermediates/import_includes) -isystem system/core/include -isystem hardware/libhardware/include -isystem hardware/libhardware_legacy/include -isystem hardware/ril/include -isystem libnativehelper/include -isystem frameworks/native/include -isystem frameworks/native/opengl/include -isystem frameworks/av/include -isystem frameworks/base/include -isystem out/target/product/generic/obj/include -isystem bionic/libc/arch-arm/include -isystem bionic/libc/include -isystem bionic/libc/kernel/uapi -isystem bionic/libc/kernel/uapi/asm-arm -isystem bionic/libm/include -isystem bionic/libm/include/arm -c  -fno-exceptions -Wno-multichar -msoft-float -ffunction-sections -fdata-sections -funwind-tables -fstack-protector -Wa,--noexecstack -Werror=format-security -D_FORTIFY_SOURCE=2 -fno-short-enums -no-canonical-prefixes -fno-canonical-system-headers -march=armv7-a -mfloat-abi=softfp -mfpu=vfpv3-d16 -include build/core/combo/include/arch/linux-arm/AndroidConfig.h -I build/core/combo/include/arch/linux-arm/ -fno-builtin-sin -fno-strict-volatile-bitfields -Wno-psabi -mthumb-interwork -DANDROID -fmessage-length=0 -W -Wall -Wno-unused -Winit-self -Wpointer-arith -Werror=return-type -Werror=non-virtual-dtor -Werror=address -Werror=sequence-point -DNDEBUG -g -Wstrict-aliasing=2 -fgcse-after-reload -frerun-cse-after-loop -frename-registers -DNDEBUG -UDEBUG     -Wa,"-I" -Wa,"external/sonivox/arm-wt-22k/lib_src" -Wa,"--defsym" -Wa,"SAMPLE_RATE_22050=1" -Wa,"--defsym" -Wa,"STEREO_OUTPUT=1" -Wa,"--defsym" -Wa,"FILTER_ENABLED=1" -Wa,"--defsym" -Wa,"SAMPLES_8_BIT=1"   -D__ASSEMBLY__ -MD -MF out/target/product/generic/obj/SHARED_LIBRARIES/libsonivox_intermediates/lib_src/ARM-E_filter_gnu.d -o out/target/product/generic/obj/SHARED_LIBRARIES/libsonivox_intermediates/lib_src/ARM-E_filter_gnu.o external/sonivox/arm-wt-22k/lib_src/ARM-E_filter_gnu.s`,
 			depfile: ``,
 		},
+		{
+			in:      `mkdir -p obj && prebuilts/clang/linux-x86/host/3.6/bin/clang -c -MD -MF obj/foo.d -o obj/foo.o src/foo.s`,
+			cmd:     `mkdir -p obj && prebuilts/clang/linux-x86/host/3.6/bin/clang -c -MD -MF obj/foo.d -o obj/foo.o src/foo.s && cp obj/foo.d obj/foo.d.tmp`,
+			depfile: `obj/foo.d.tmp`,
+		},
+		{
+			in:      `prebuilts/misc/linux-x86/ccache/ccache prebuilts/clang/linux-x86/host/3.6/bin/clang -c -MD -MF obj/foo.d -o obj/foo.o src/foo.S`,
+			cmd:     `prebuilts/misc/linux-x86/ccache/ccache prebuilts/clang/linux-x86/host/3.6/bin/clang -c -MD -MF obj/foo.d -o obj/foo.o src/foo.S && cp obj/foo.d obj/foo.d.tmp`,
+			depfile: `obj/foo.d.tmp`,
+		},
+		{
+			in:      `prebuilts/misc/linux-x86/ccache/ccache prebuilts/gcc/linux-x86/arm/arm-linux-androideabi-4.9/bin/arm-linux-androideabi-gcc -c -MD -MF obj/foo.d -o obj/foo.o src/foo.s`,
+			depfile: ``,
+		},
 		{
 			in:      `echo "RenderScript: Galaxy4 <= packages/wallpapers/Galaxy4/src/com/android/galaxy4/galaxy.rs" && rm -rf out/target/common/obj/APPS/Galaxy4_intermediates/src/renderscript && mkdir -p out/target/common/obj/APPS/Galaxy4_intermediates/src/renderscript/res/raw && mkdir -p out/target/common/obj/APPS/Galaxy4_intermediates/src/renderscript/src && out/host/linux-x86/bin/llvm-rs-cc -o out/target/common/obj/APPS/Galaxy4_intermediates/src/renderscript/res/raw -p out/target/common/obj/APPS/Galaxy4_intermediates/src/renderscript/src -d out/target/common/obj/APPS/Galaxy4_intermediates/src/renderscript -a out/target/common/obj/APPS/Galaxy4_intermediates/src/RenderScript.stamp -MD -target-api 14 -Wall -Werror  -I prebuilts/sdk/renderscript/clang-include -I prebuilts/sdk/renderscript/include packages/wallpapers/Galaxy4/src/com/android/galaxy4/galaxy.rs && mkdir -p out/target/common/obj/APPS/Galaxy4_intermediates/src/ && touch out/target/common/obj/APPS/Galaxy4_intermediates/src/RenderScript.stamp`,
 			depfile: ``,
@@ -167,6 +261,163 @@ func TestGetDepFile(t *testing.T) {
 	}
 }
 
+func TestNormalizeDepfileFlag(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		cmd     string
+		depfile string
+		ok      bool
+	}{
+		{
+			in:      `g++ -c fat.cc -MD -o fat.o`,
+			cmd:     `g++ -c fat.cc -MD -MF fat.o.d -o fat.o`,
+			depfile: `fat.o.d`,
+			ok:      true,
+		},
+		{
+			in:      `g++ -MMD -c -o out/fat.o fat.cc`,
+			cmd:     `g++ -MMD -MF out/fat.o.d -c -o out/fat.o fat.cc`,
+			depfile: `out/fat.o.d`,
+			ok:      true,
+		},
+		{
+			in: `g++ -c fat.cc -MD -MF foo.d -o fat.o`,
+		},
+		{
+			in: `g++ -c fat.cc -o fat.o`,
+		},
+		{
+			in: `mkdir -p out && g++ -c fat.cc -MD -o out/fat.o`,
+		},
+		{
+			in:      `g++ -c fat.cc -MD -o "out dir/fat.o"`,
+			cmd:     `g++ -c fat.cc -MD -MF 'out dir/fat.o.d' -o "out dir/fat.o"`,
+			depfile: `out dir/fat.o.d`,
+			ok:      true,
+		},
+		{
+			in:      `g++ -MMD -c -o 'out dir/fat.o' fat.cc`,
+			cmd:     `g++ -MMD -MF 'out dir/fat.o.d' -c -o 'out dir/fat.o' fat.cc`,
+			depfile: `out dir/fat.o.d`,
+			ok:      true,
+		},
+		{
+			in: `g++ -c fat.cc -MD -o`,
+		},
+	} {
+		cmd, depfile, ok := normalizeDepfileFlag(tc.in)
+		if ok != tc.ok {
+			t.Errorf("normalizeDepfileFlag(%q)=_, _, %t; want=_, _, %t", tc.in, ok, tc.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if cmd != tc.cmd || depfile != tc.depfile {
+			t.Errorf("normalizeDepfileFlag(%q)=%q, %q, _; want=%q, %q, _", tc.in, cmd, depfile, tc.cmd, tc.depfile)
+		}
+	}
+
+	// Compare with the copy of the depfile.
+	const in = `g++ -c fat.cc -MD -o fat.o`
+	for _, tc := range []struct {
+		normalize bool
+		version   string
+		cmd       string
+		depfile   string
+	}{
+		{
+			cmd:     `g++ -c fat.cc -MD -o fat.o && cp fat.d fat.d.tmp`,
+			depfile: `fat.d.tmp`,
+		},
+		{
+			normalize: true,
+			cmd:       `g++ -c fat.cc -MD -MF fat.o.d -o fat.o`,
+			depfile:   `fat.o.d`,
+		},
+		{
+			version: "1.2",
+			cmd:     `g++ -c fat.cc -MD -o fat.o && cp fat.d fat.d.tmp`,
+			depfile: `fat.d.tmp`,
+		},
+		{
+			version: "1.3",
+			cmd:     `g++ -c fat.cc -MD -o fat.o`,
+			depfile: `fat.d`,
+		},
+	} {
+		n := &NinjaGenerator{NormalizeDepfileFlag: tc.normalize, NinjaVersion: tc.version}
+		cmd, depfile, err := n.getDepfile(in)
+		if err != nil {
+			t.Errorf("getDepfile(%q) normalize=%t version=%q: %v", in, tc.normalize, tc.version, err)
+			continue
+		}
+		if cmd != tc.cmd || depfile != tc.depfile {
+			t.Errorf("getDepfile(%q) normalize=%t version=%q=%q, %q, _; want=%q, %q, _", in, tc.normalize, tc.version, cmd, depfile, tc.cmd, tc.depfile)
+		}
+	}
+}
+
+func TestLastDepfileWins(t *testing.T) {
+	const in = `g++ -MD -MF wrapper.d -c fat.cc -MF fat.d -o fat.o`
+	for _, tc := range []struct {
+		lastWins bool
+		depfile  string
+		err      bool
+	}{
+		{err: true},
+		{lastWins: true, depfile: "fat.d.tmp"},
+	} {
+		n := &NinjaGenerator{LastDepfileWins: tc.lastWins}
+		_, depfile, err := n.getDepfile(in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("getDepfile(%q) LastDepfileWins=%t: no error", in, tc.lastWins)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("getDepfile(%q) LastDepfileWins=%t: %v", in, tc.lastWins, err)
+			continue
+		}
+		if depfile != tc.depfile {
+			t.Errorf("getDepfile(%q) LastDepfileWins=%t=_, %q, _; want=_, %q, _", in, tc.lastWins, depfile, tc.depfile)
+		}
+	}
+}
+
+func TestExpandResponseFiles(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	rsp := filepath.Join(dir, "args.rsp")
+	err := ioutil.WriteFile(rsp, []byte("-c fat.cc\n-MD -MF out/fat.d\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		in      string
+		expand  bool
+		depfile string
+	}{
+		{in: "g++ @" + rsp + " -o out/fat.o"},
+		{in: "g++ @" + rsp + " -o out/fat.o", expand: true, depfile: "out/fat.d.tmp"},
+		{in: "g++ @" + filepath.Join(dir, "missing.rsp") + " -o out/fat.o", expand: true},
+	} {
+		n := &NinjaGenerator{ExpandResponseFiles: tc.expand}
+		cmd, depfile, err := n.getDepfile(tc.in)
+		if err != nil {
+			t.Errorf("getDepfile(%q) expand=%t: %v", tc.in, tc.expand, err)
+			continue
+		}
+		if depfile != tc.depfile {
+			t.Errorf("getDepfile(%q) expand=%t=_, %q, _; want=_, %q, _", tc.in, tc.expand, depfile, tc.depfile)
+		}
+		if !strings.HasPrefix(cmd, tc.in) {
+			t.Errorf("getDepfile(%q) expand=%t=%q, _, _; want the command kept", tc.in, tc.expand, cmd)
+		}
+	}
+}
+
 func TestGomaCmdForAndroidCompileCmd(t *testing.T) {
 	for _, tc := range []struct {
 		in   string
@@ -182,6 +433,49 @@ func TestGomaCmdForAndroidCompileCmd(t *testing.T) {
 			want: "prebuilts/clang/linux-x86/host/3.6/bin/clang++ -c foo.c ",
 			ok:   true,
 		},
+		{
+			in: "prebuilts/clang/linux-x86/host/3.6/bin/clang -c -MD -MF obj/foo.d -o obj/foo.o src/foo.S ",
+			ok: true,
+		},
+		{
+			in:   "CCACHE_DIR=/tmp/ccache CCACHE_BASEDIR=$PWD prebuilts/misc/linux-x86/ccache/ccache prebuilts/clang/linux-x86/host/3.6/bin/clang++ -c foo.c ",
+			want: "prebuilts/clang/linux-x86/host/3.6/bin/clang++ -c foo.c ",
+			ok:   true,
+		},
+		{
+			in:   "/usr/bin/sccache --some-option prebuilts/clang/linux-x86/host/3.6/bin/clang -c foo.c ",
+			want: "prebuilts/clang/linux-x86/host/3.6/bin/clang -c foo.c ",
+			ok:   true,
+		},
+		{
+			in:   "/usr/lib/ccache/clang -c foo.c ",
+			want: "clang -c foo.c ",
+			ok:   false,
+		},
+		{
+			in: "prebuilts/gcc/linux-x86/arm/arm-linux-androideabi-4.9/bin/arm-linux-androideabi-gcc -c foo.c -o foo.o ",
+			ok: true,
+		},
+		{
+			in: "prebuilts/gcc/linux-x86/host/bin/some-tool --flag gcc -c foo ",
+			ok: false,
+		},
+		{
+			in: "prebuilts/clang/linux-x86/host/bin/clang-format --style=clang -c foo.c ",
+			ok: false,
+		},
+		{
+			in: "prebuilts/clang/host/clang/bin/llvm-objcopy -c foo ",
+			ok: false,
+		},
+		{
+			in: "prebuilts/gcc/bin/tool foo.c && clang -c bar.c ",
+			ok: false,
+		},
+		{
+			in: "FOO=bar echo foo ",
+			ok: false,
+		},
 		{
 			in: "echo foo ",
 			ok: false,
@@ -200,3 +494,3046 @@ func TestGomaCmdForAndroidCompileCmd(t *testing.T) {
 		}
 	}
 }
+
+func genNinjaForTest(t *testing.T, n *NinjaGenerator, nodes []*DepNode, defaultTarget string) string {
+	g := &DepGraph{
+		nodes: nodes,
+		vars: Vars{
+			"SHELL": &simpleVar{value: []string{"/bin/sh"}, origin: "file"},
+		},
+	}
+	return genNinjaForGraph(t, n, g, defaultTarget)
+}
+
+func genNinjaForGraph(t *testing.T, n *NinjaGenerator, g *DepGraph, defaultTarget string) string {
+	n.init(g)
+	var buf bytes.Buffer
+	n.f = &buf
+	err := n.emitNinja(defaultTarget)
+	if err != nil {
+		t.Fatalf("emitNinja: %v", err)
+	}
+	return buf.String()
+}
+
+// tempDir creates a temporary directory, and returns it with a func
+// which removes it.
+func tempDir(tb testing.TB) (string, func()) {
+	dir, err := ioutil.TempDir("", "kati")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return dir, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+// inTempDir changes the working directory to a new temporary
+// directory, and returns a func which restores it and removes the
+// directory.
+func inTempDir(tb testing.TB) func() {
+	dir, cleanup := tempDir(tb)
+	wd, err := os.Getwd()
+	if err != nil {
+		cleanup()
+		tb.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		cleanup()
+		tb.Fatal(err)
+	}
+	return func() {
+		os.Chdir(wd)
+		cleanup()
+	}
+}
+
+// withUsedEnvs replaces usedEnvs with names, and returns a func which
+// restores it.
+func withUsedEnvs(names ...string) func() {
+	saved := usedEnvs
+	usedEnvs = make(map[string]bool)
+	for _, name := range names {
+		usedEnvs[name] = true
+	}
+	return func() {
+		usedEnvs = saved
+	}
+}
+
+func TestGenShellScriptCompilerWrapper(t *testing.T) {
+	const cc = "prebuilts/clang/linux-x86/host/3.6/bin/clang++ -c foo.c"
+	for _, tc := range []struct {
+		n    *NinjaGenerator
+		want string
+	}{
+		{
+			n:    &NinjaGenerator{},
+			want: cc,
+		},
+		{
+			n:    &NinjaGenerator{GomaDir: "/goma"},
+			want: "/goma/gomacc " + cc,
+		},
+		{
+			n:    &NinjaGenerator{GomaDir: "/goma", GomaccPath: "gomacc"},
+			want: "gomacc " + cc,
+		},
+		{
+			n: &NinjaGenerator{
+				GomaDir:         "/goma",
+				CompilerWrapper: DistccCompilerWrapper,
+			},
+			want: "distcc " + cc,
+		},
+		{
+			n:    &NinjaGenerator{GomaDir: "/goma", GomaCompileRE: regexp.MustCompile(`^toolchain/bin/clang `)},
+			want: cc,
+		},
+		{
+			n:    &NinjaGenerator{GomaDir: "/goma", GomaCompileRE: regexp.MustCompile(`/clang\+\+ .*-c `)},
+			want: "/goma/gomacc " + cc,
+		},
+		{
+			n: &NinjaGenerator{
+				CompilerWrapper: func(cmd string) (string, bool) {
+					return cmd, false
+				},
+			},
+			want: cc,
+		},
+	} {
+		got, _, _ := tc.n.genShellScript([]runner{{cmd: cc}})
+		if got != tc.want {
+			t.Errorf("genShellScript(%q)=%q; want=%q", cc, got, tc.want)
+		}
+	}
+}
+
+func TestEmitImplicitOutputs(t *testing.T) {
+	node := &DepNode{
+		Output:          "main.o",
+		ImplicitOutputs: []string{"side.dwo", "side.gcno"},
+		Cmds:            []string{"touch $@"},
+		HasRule:         true,
+	}
+	for _, tc := range []struct {
+		version string
+		want    []string
+	}{
+		{
+			version: "1.7",
+			want: []string{
+				"build main.o | side.dwo side.gcno: rule0\n",
+				` command = /bin/sh -c "touch ${out}"`,
+			},
+		},
+		{
+			version: "",
+			want: []string{
+				"build main.o: rule0\n",
+				"build side.dwo: phony main.o\n",
+				"build side.gcno: phony main.o\n",
+			},
+		},
+	} {
+		n := &NinjaGenerator{NinjaVersion: tc.version}
+		got := genNinjaForTest(t, n, []*DepNode{node}, "")
+		for _, w := range tc.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("ninja version %q: output doesn't contain %q\n%s", tc.version, w, got)
+			}
+		}
+	}
+}
+
+func TestEmitLocalPoolDepth(t *testing.T) {
+	n := &NinjaGenerator{GomaDir: "/goma", LocalPoolDepth: 3}
+	got := genNinjaForTest(t, n, nil, "")
+	if want := "pool local_pool\n depth = 3\n"; !strings.Contains(got, want) {
+		t.Errorf("output doesn't contain %q\n%s", want, got)
+	}
+}
+
+func TestEmitCleanTmp(t *testing.T) {
+	nodes := []*DepNode{
+		{Output: "all", HasRule: true},
+		{Output: "foo.o", Cmds: []string{"gcc -MD -c foo.c -o foo.o"}, HasRule: true},
+		{Output: "bar.o", Cmds: []string{"gcc -MD -c bar.c -o bar.o"}, HasRule: true},
+	}
+	nodes[0].Deps = nodes[1:]
+	n := &NinjaGenerator{}
+	got := genNinjaForTest(t, n, nodes, "")
+	for _, w := range []string{
+		"\nrule clean_katitmp\n",
+		" rspfile_content = rm -f foo.d.tmp bar.d.tmp\n",
+		"\nbuild clean_katitmp: clean_katitmp\n",
+	} {
+		if !strings.Contains(got, w) {
+			t.Errorf("output doesn't contain %q\n%s", w, got)
+		}
+	}
+
+	got = genNinjaForTest(t, &NinjaGenerator{}, []*DepNode{{Output: "all", Cmds: []string{"true"}, HasRule: true}}, "")
+	if strings.Contains(got, "clean_katitmp") {
+		t.Errorf("output has clean_katitmp without depfiles\n%s", got)
+	}
+}
+
+func TestEmitCleanTmpSpecialChars(t *testing.T) {
+	defer inTempDir(t)()
+	tmpFiles := []string{"a b.d.tmp", `it's "q".d.tmp`, `back\slash$x.d.tmp`}
+	keep := []string{"a", "b.d.tmp", "it's", "back"}
+	for _, f := range append(tmpFiles, keep...) {
+		err := ioutil.WriteFile(f, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := &NinjaGenerator{}
+	var buf bytes.Buffer
+	n.f = &buf
+	n.done = make(map[string]nodeState)
+	n.tmpFiles = tmpFiles
+	n.emitCleanTmp()
+	const prefix = " rspfile_content = "
+	var rsp string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			rsp = strings.Replace(line[len(prefix):], "$$", "$", -1)
+		}
+	}
+	if !strings.Contains(buf.String(), " command = /bin/sh $out.rsp\n") {
+		t.Errorf("unexpected command\n%s", buf.String())
+	}
+	out, err := exec.Command("/bin/sh", "-c", rsp).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%q: %v\n%s", rsp, err, out)
+	}
+	for _, f := range tmpFiles {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Errorf("%q is not removed by %q: %v", f, rsp, err)
+		}
+	}
+	for _, f := range keep {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("%q is removed by %q: %v", f, rsp, err)
+		}
+	}
+}
+
+func TestIsLinkCmd(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want bool
+	}{
+		{in: "prebuilts/clang/linux-x86/host/3.6/bin/clang++ -shared foo.o -o libfoo.so", want: true},
+		{in: "mkdir -p out && (g++ foo.o -o out/libfoo.so)", want: true},
+		{in: "prebuilts/gcc/linux-x86/arm/arm-linux-androideabi-4.9/bin/arm-linux-androideabi-ld -o foo foo.o", want: true},
+		{in: "rm -f libfoo.a && ar crsD libfoo.a foo.o", want: true},
+		{in: "g++ -c foo.cc -o foo.o", want: false},
+		{in: "cp libfoo.so out/libfoo.so", want: false},
+		{in: "echo -shared", want: false},
+		{in: "ar", want: false},
+	} {
+		if got := isLinkCmd(tc.in); got != tc.want {
+			t.Errorf("isLinkCmd(%q)=%t; want=%t", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestEmitLinkPool(t *testing.T) {
+	nodes := []*DepNode{
+		{Output: "all", HasRule: true},
+		{Output: "libfoo.so", Cmds: []string{"g++ -shared -o $@ foo.o"}, HasRule: true},
+		{Output: "foo.o", Cmds: []string{"g++ -c -o $@ foo.cc"}, HasRule: true},
+	}
+	nodes[0].Deps = nodes[1:]
+	n := &NinjaGenerator{LinkPoolDepth: 2}
+	got := genNinjaForTest(t, n, nodes, "")
+	for _, w := range []string{
+		"pool link_pool\n depth = 2\n",
+		"build libfoo.so: rule0\n pool = link_pool\n",
+	} {
+		if !strings.Contains(got, w) {
+			t.Errorf("output doesn't contain %q\n%s", w, got)
+		}
+	}
+	if c := strings.Count(got, " pool = "); c != 1 {
+		t.Errorf("output has %d pools; want 1\n%s", c, got)
+	}
+}
+
+func TestMaxRuleNameLen(t *testing.T) {
+	all := &DepNode{Output: "all", HasRule: true, IsPhony: true}
+	for i := 0; i < 1000; i++ {
+		all.Deps = append(all.Deps, &DepNode{
+			Output:  fmt.Sprintf("out%d", i),
+			Cmds:    []string{fmt.Sprintf("echo %d > $@", i)},
+			HasRule: true,
+		})
+	}
+	n := &NinjaGenerator{MaxRuleNameLen: 3}
+	got := genNinjaForTest(t, n, []*DepNode{all}, "")
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(got, "\n") {
+		if !strings.HasPrefix(line, "rule ") {
+			continue
+		}
+		name := strings.TrimPrefix(line, "rule ")
+		if len(name) > 3 {
+			t.Errorf("rule name %q is longer than 3", name)
+		}
+		if seen[name] {
+			t.Errorf("rule name %q is not unique", name)
+		}
+		seen[name] = true
+	}
+	if len(seen) != 1000 {
+		t.Errorf("%d rules; want 1000", len(seen))
+	}
+
+	n = &NinjaGenerator{MaxRuleNameLen: 2}
+	n.init(&DepGraph{
+		nodes: []*DepNode{all},
+		vars:  Vars{"SHELL": &simpleVar{value: []string{"/bin/sh"}, origin: "file"}},
+	})
+	n.f = &bytes.Buffer{}
+	if err := n.emitNinja(""); err == nil {
+		t.Errorf("emitNinja with 1000 rules of 2 characters: no error")
+	}
+}
+
+func TestEmitHoistedInputs(t *testing.T) {
+	var libs []*DepNode
+	var names []string
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("out/obj/STATIC_LIBRARIES/lib%d_intermediates/lib%d.a", i, i)
+		libs = append(libs, &DepNode{Output: name})
+		names = append(names, name)
+	}
+	all := &DepNode{Output: "all", HasRule: true, IsPhony: true}
+	for _, tc := range []struct {
+		output string
+		cmd    string
+	}{
+		{output: "out/a", cmd: "link -o $@ @libs.rsp"},
+		{output: "out/b", cmd: "link -o $@ @libs.rsp"},
+		{output: "out/c", cmd: "link -o $@ $^"},
+	} {
+		all.Deps = append(all.Deps, &DepNode{
+			Output:       tc.output,
+			Cmds:         []string{tc.cmd},
+			Deps:         libs,
+			ActualInputs: names,
+			HasRule:      true,
+		})
+	}
+	n := &NinjaGenerator{HoistInputs: true}
+	got := genNinjaForTest(t, n, []*DepNode{all}, "")
+	for _, w := range []string{
+		"build kati_inputs0: phony " + strings.Join(names, " ") + "\n",
+		"build out/a: rule0 kati_inputs0\n",
+		"build out/b: rule1 kati_inputs0\n",
+		// $in is used.
+		"build out/c: rule2 " + strings.Join(names, " ") + "\n",
+	} {
+		if !strings.Contains(got, w) {
+			t.Errorf("output doesn't contain %q\n%s", w, got)
+		}
+	}
+	if strings.Contains(got, "kati_inputs1") {
+		t.Errorf("output has unexpected kati_inputs1\n%s", got)
+	}
+}
+
+func TestCheckCommandCount(t *testing.T) {
+	var cmds []string
+	for i := 0; i < 10; i++ {
+		cmds = append(cmds, fmt.Sprintf("echo %d", i))
+	}
+	node := &DepNode{
+		Output:   "out",
+		Cmds:     cmds,
+		HasRule:  true,
+		Filename: "Makefile",
+		Lineno:   1,
+	}
+	for _, tc := range []struct {
+		max  int
+		warn bool
+	}{
+		{max: 0},
+		{max: 9, warn: true},
+		{max: 10},
+	} {
+		n := &NinjaGenerator{MaxCommands: tc.max}
+		n.init(&DepGraph{
+			nodes: []*DepNode{node},
+			vars:  Vars{"SHELL": &simpleVar{value: []string{"/bin/sh"}, origin: "file"}},
+		})
+		cmd := n.newNinjaCommand(n.ctx, node)
+		if cmd.numRunners != 10 {
+			t.Errorf("numRunners=%d; want=10", cmd.numRunners)
+		}
+		msg := n.checkCommandCount(node, cmd.numRunners)
+		if got := msg != ""; got != tc.warn {
+			t.Errorf("MaxCommands=%d: warning %q; want warning=%t", tc.max, msg, tc.warn)
+		}
+	}
+}
+
+func TestCheckCycles(t *testing.T) {
+	a := &DepNode{Output: "a"}
+	b := &DepNode{Output: "b"}
+	c := &DepNode{Output: "c"}
+	d := &DepNode{Output: "d"}
+	a.Deps = []*DepNode{d, b}
+	b.Deps = []*DepNode{d}
+	b.OrderOnlys = []*DepNode{c}
+	err := checkCycles([]*DepNode{a})
+	if err != nil {
+		t.Errorf("checkCycles: %v", err)
+	}
+
+	c.Deps = []*DepNode{a}
+	err = checkCycles([]*DepNode{a})
+	if want := "*** dependency cycle: a -> b -> c -> a"; err == nil || err.Error() != want {
+		t.Errorf("checkCycles: %v; want %q", err, want)
+	}
+
+	self := &DepNode{Output: "self"}
+	self.Deps = []*DepNode{self}
+	err = checkCycles([]*DepNode{self})
+	if want := "*** dependency cycle: self -> self"; err == nil || err.Error() != want {
+		t.Errorf("checkCycles: %v; want %q", err, want)
+	}
+}
+
+func TestEmitRecipeWrapper(t *testing.T) {
+	for _, tc := range []struct {
+		cmd  string
+		want []string
+	}{
+		{
+			cmd:  "touch $@",
+			want: []string{` command = kati_sandbox -- /bin/sh -c "touch ${out}"`},
+		},
+		{
+			cmd: "echo " + strings.Repeat("x", 100*1000),
+			want: []string{
+				" rspfile = $out.rsp\n",
+				" command = kati_sandbox -- /bin/sh $out.rsp\n",
+			},
+		},
+	} {
+		node := &DepNode{
+			Output:  "out",
+			Cmds:    []string{tc.cmd},
+			HasRule: true,
+		}
+		n := &NinjaGenerator{RecipeWrapper: []string{"kati_sandbox", "--"}}
+		got := genNinjaForTest(t, n, []*DepNode{node}, "")
+		for _, w := range tc.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("output doesn't contain %q\n%.1000s", w, got)
+			}
+		}
+	}
+}
+
+func TestEmitRecipeWrapperQuoted(t *testing.T) {
+	node := &DepNode{
+		Output:  "out",
+		Cmds:    []string{"touch $@"},
+		HasRule: true,
+	}
+	n := &NinjaGenerator{RecipeWrapper: []string{"kati_sandbox", "--log=my log;$HOME", "--"}}
+	got := genNinjaForTest(t, n, []*DepNode{node}, "")
+	if want := ` command = kati_sandbox '--log=my log;$$HOME' -- /bin/sh -c "touch ${out}"`; !strings.Contains(got, want) {
+		t.Errorf("output doesn't contain %q\n%s", want, got)
+	}
+}
+
+func TestEmitMultiLineCommand(t *testing.T) {
+	node := &DepNode{
+		Output:  "out",
+		Cmds:    []string{"echo 'a\n\tb' > out"},
+		HasRule: true,
+	}
+	n := &NinjaGenerator{}
+	got := genNinjaForTest(t, n, []*DepNode{node}, "")
+	want := " command = kati_nl=$$(printf '\\n.') && kati_nl=$${kati_nl%.} && /bin/sh -c \"echo 'a$${kati_nl}\tb' > ${out}\"\n"
+	if !strings.Contains(got, want) {
+		t.Errorf("output doesn't contain %q\n%s", want, got)
+	}
+}
+
+func TestEmitRegenDepfile(t *testing.T) {
+	n := &NinjaGenerator{
+		Args: []string{"kati", "--ninja"},
+		accessedMks: []*accessedMakefile{
+			{Filename: "Makefile", State: fileExists},
+			{Filename: "sub dir/a.mk", State: fileExists},
+			{Filename: "missing.mk", State: fileNotExists},
+			{Filename: "Makefile", State: fileExists},
+		},
+	}
+	var buf bytes.Buffer
+	err := n.emitRegenDepfile(&buf)
+	if err != nil {
+		t.Fatalf("emitRegenDepfile: %v", err)
+	}
+	want := "build.ninja: \\\n Makefile \\\n sub\\ dir/a.mk\n"
+	if got := buf.String(); got != want {
+		t.Errorf("emitRegenDepfile=%q; want=%q", got, want)
+	}
+}
+
+func TestEmitShortcuts(t *testing.T) {
+	var nodes []*DepNode
+	for _, o := range []string{"out/a/foo", "out/b/foo", "out/a/bar"} {
+		nodes = append(nodes, &DepNode{
+			Output:  o,
+			Cmds:    []string{"touch $@"},
+			HasRule: true,
+		})
+	}
+	n := &NinjaGenerator{Shortcuts: true}
+	got := genNinjaForTest(t, n, nodes, "")
+	if want := "build bar: phony out/a/bar\n"; !strings.Contains(got, want) {
+		t.Errorf("output doesn't contain %q\n%s", want, got)
+	}
+	if strings.Contains(got, "build foo:") {
+		t.Errorf("ambiguous shortcut foo is emitted\n%s", got)
+	}
+}
+
+func TestEmitPackagesOutside(t *testing.T) {
+	for _, tc := range []struct {
+		pkg string
+		ok  bool
+	}{
+		{pkg: "frameworks/base", ok: true},
+		{pkg: "a/../b", ok: true},
+		{pkg: "../escape"},
+		{pkg: "a/../../escape"},
+		{pkg: "/etc/evil"},
+		{pkg: ".."},
+	} {
+		n := &NinjaGenerator{}
+		n.init(&DepGraph{
+			nodes: []*DepNode{{
+				Output:   "out/foo.so",
+				Cmds:     []string{"touch $@"},
+				HasRule:  true,
+				Package:  tc.pkg,
+				Filename: "foo.mk",
+				Lineno:   3,
+			}},
+			vars: Vars{"SHELL": &simpleVar{value: []string{"/bin/sh"}, origin: "file"}},
+		})
+		n.f = ioutil.Discard
+		err := n.emitNinja("")
+		if tc.ok {
+			if err != nil {
+				t.Errorf(".KATI_PACKAGE %q: %v", tc.pkg, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf(".KATI_PACKAGE %q: no error", tc.pkg)
+			continue
+		}
+		if want := fmt.Sprintf(`foo.mk:3: recipe for "out/foo.so": .KATI_PACKAGE %q is outside of the packages directory`, tc.pkg); err.Error() != want {
+			t.Errorf(".KATI_PACKAGE %q: %q; want=%q", tc.pkg, err, want)
+		}
+	}
+}
+
+func TestEmitPackages(t *testing.T) {
+	common := &DepNode{
+		Output:  "out/common.o",
+		Cmds:    []string{"touch $@"},
+		HasRule: true,
+	}
+	base := &DepNode{
+		Output:  "out/base.so",
+		Cmds:    []string{"touch $@"},
+		Deps:    []*DepNode{common},
+		HasRule: true,
+		Package: "frameworks/base",
+	}
+	media := &DepNode{
+		Output:  "out/media.so",
+		Cmds:    []string{"touch $@"},
+		Deps:    []*DepNode{common},
+		HasRule: true,
+		Package: "frameworks/av",
+	}
+	all := &DepNode{
+		Output:  "all",
+		Deps:    []*DepNode{base, media},
+		HasRule: true,
+		IsPhony: true,
+	}
+	n := &NinjaGenerator{}
+	got := genNinjaForTest(t, n, []*DepNode{all}, "all")
+	for _, want := range []string{
+		"build all: phony out/base.so out/media.so\n",
+		"subninja build.packages/frameworks/av.ninja\n",
+		"subninja build.packages/frameworks/base.ninja\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output doesn't contain %q\n%s", want, got)
+		}
+	}
+	for _, tc := range []struct {
+		pkg  string
+		want []string
+	}{
+		{
+			pkg:  "frameworks/base",
+			want: []string{"rule rule0\n", "build out/base.so: rule0 out/common.o\n", "rule rule1\n", "build out/common.o: rule1\n"},
+		},
+		{
+			pkg:  "frameworks/av",
+			want: []string{"rule rule2\n", "build out/media.so: rule2 out/common.o\n"},
+		},
+	} {
+		w, ok := n.pkgs[tc.pkg]
+		if !ok {
+			t.Errorf("no fragment for %q", tc.pkg)
+			continue
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(w.String(), want) {
+				t.Errorf("fragment %q doesn't contain %q\n%s", tc.pkg, want, w)
+			}
+		}
+	}
+	if strings.Contains(got, "rule rule") {
+		t.Errorf("rules of packages are in the top-level file\n%s", got)
+	}
+}
+
+func TestEmitRegenRulesGlobDirs(t *testing.T) {
+	n := &NinjaGenerator{
+		Args:            []string{"kati", "--ninja"},
+		RegenIgnoreDirs: []string{"out/*"},
+	}
+	g := &DepGraph{
+		vars:     make(Vars),
+		globDirs: []string{"out/gen", "src", "src dir"},
+	}
+	n.init(g)
+	var buf bytes.Buffer
+	n.f = &buf
+	err := n.emitRegenRules()
+	if err != nil {
+		t.Fatalf("emitRegenRules: %v", err)
+	}
+	got := buf.String()
+	if want := " | src src$ dir\n"; !strings.Contains(got, want) {
+		t.Errorf("regen rule doesn't contain %q\n%s", want, got)
+	}
+	if strings.Contains(got, "out/gen") {
+		t.Errorf("ignored dir out/gen is in regen rule\n%s", got)
+	}
+}
+
+func TestNinjaRegenDirsPhony(t *testing.T) {
+	g := &DepGraph{
+		nodes: []*DepNode{
+			{Output: "all", Deps: []*DepNode{{Output: "gen", Cmds: []string{"mkdir -p $@"}, HasRule: true}}, HasRule: true, IsPhony: true},
+		},
+		vars: Vars{
+			"SHELL": &simpleVar{value: []string{"/bin/sh"}, origin: "file"},
+		},
+		globDirs: []string{"gen", "src", "src dir"},
+	}
+	got := genNinjaForGraph(t, &NinjaGenerator{Args: []string{"kati", "--ninja"}}, g, "all")
+	for _, want := range []string{
+		" | gen src src$ dir\n",
+		"\nbuild src: phony\n",
+		"\nbuild src$ dir: phony\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output doesn't contain %q\n%s", want, got)
+		}
+	}
+	if c := strings.Count(got, "\nbuild gen:"); c != 1 {
+		t.Errorf("output has %d build statements for gen; want 1\n%s", c, got)
+	}
+}
+
+func TestEmitRegenRulesOutputDirs(t *testing.T) {
+	g := loadMakefileForTest(t, "SRCS := $(wildcard *.go)\nall:\n", []string{"all"})
+	if len(g.globDirs) == 0 {
+		t.Fatalf("no globbed directory for root-level wildcard")
+	}
+	g.globDirs = append(g.globDirs, "out", "out/build.packages", "./src")
+	n := &NinjaGenerator{
+		Args:   []string{"kati", "--ninja"},
+		OutDir: "out",
+	}
+	n.init(g)
+	var buf bytes.Buffer
+	n.f = &buf
+	err := n.emitRegenRules()
+	if err != nil {
+		t.Fatalf("emitRegenRules: %v", err)
+	}
+	got := buf.String()
+	if want := " | ./src\n"; !strings.Contains(got, want) {
+		t.Errorf("regen rule doesn't contain %q\n%s", want, got)
+	}
+}
+
+func TestNinjaEnvOrderStable(t *testing.T) {
+	defer withUsedEnvs()()
+	for _, name := range []string{"ZETA", "ALPHA", "MID", "BETA"} {
+		usedEnvs[name] = true
+	}
+	g := loadMakefileForTest(t, "ZETA := z\nALPHA := a\nMID := m\nBETA := b\nall:\n", []string{"all"})
+	var first string
+	for i := 0; i < 10; i++ {
+		got := genNinjaForGraph(t, &NinjaGenerator{Args: []string{"kati", "--ninja"}}, g, "all")
+		if i == 0 {
+			first = got
+			want := "# \"ALPHA\"=\"a\"\n# \"BETA\"=\"b\"\n# \"MID\"=\"m\"\n# \"ZETA\"=\"z\"\n"
+			if !strings.Contains(got, want) {
+				t.Errorf("output doesn't contain %q\n%s", want, got)
+			}
+			continue
+		}
+		if got != first {
+			t.Fatalf("output differs between runs\n%s\n---\n%s", first, got)
+		}
+	}
+}
+
+func TestUsedEnvNames(t *testing.T) {
+	defer withUsedEnvs("PATH", "PWD", "SSH_AUTH_SOCK", "TARGET_ARCH", "TARGET_PWD")()
+	for _, tc := range []struct {
+		allow  []string
+		ignore []string
+		want   []string
+	}{
+		{
+			want: []string{"PATH", "PWD", "SSH_AUTH_SOCK", "TARGET_ARCH", "TARGET_PWD"},
+		},
+		{
+			ignore: []string{"SSH_*", "PWD"},
+			want:   []string{"PATH", "TARGET_ARCH", "TARGET_PWD"},
+		},
+		{
+			allow: []string{"TARGET_*"},
+			want:  []string{"TARGET_ARCH", "TARGET_PWD"},
+		},
+		{
+			allow:  []string{"TARGET_*", "PWD"},
+			ignore: []string{"*PWD"},
+			want:   []string{"TARGET_ARCH"},
+		},
+	} {
+		n := &NinjaGenerator{EnvAllow: tc.allow, EnvIgnore: tc.ignore}
+		got := n.usedEnvNames()
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("usedEnvNames() with allow=%q ignore=%q=%q; want=%q", tc.allow, tc.ignore, got, tc.want)
+		}
+	}
+}
+
+func TestRunnerEvalContinuation(t *testing.T) {
+	ev := NewEvaluator(Vars{
+		"LINES": &simpleVar{value: []string{"a \\\nb \\\nc\nd"}, origin: "file"},
+	})
+	runners, err := runner{echo: true}.eval(ev, "$(LINES)")
+	if err != nil {
+		t.Fatalf("eval: %v", err)
+	}
+	var got []string
+	for _, r := range runners {
+		got = append(got, r.cmd)
+	}
+	want := []string{"a \\\nb \\\nc", "d"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("eval=%q; want=%q", got, want)
+	}
+}
+
+func largeRecipe(lines int) string {
+	var buf bytes.Buffer
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&buf, "echo line%d \\\n\t", i)
+	}
+	buf.WriteString("true")
+	return buf.String()
+}
+
+func benchmarkGenShellScript(b *testing.B, lines int) {
+	ev := NewEvaluator(Vars{
+		"RECIPE": &simpleVar{value: []string{largeRecipe(lines)}, origin: "file"},
+	})
+	n := &NinjaGenerator{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runners, err := runner{echo: true}.eval(ev, "$(RECIPE)")
+		if err != nil {
+			b.Fatal(err)
+		}
+		n.genShellScript(runners)
+	}
+}
+
+func BenchmarkGenShellScript1000(b *testing.B)  { benchmarkGenShellScript(b, 1000) }
+func BenchmarkGenShellScript10000(b *testing.B) { benchmarkGenShellScript(b, 10000) }
+
+func BenchmarkGenerateNinja(b *testing.B) {
+	defer inTempDir(b)()
+
+	all := &DepNode{Output: "all", HasRule: true, IsPhony: true}
+	for i := 0; i < 10000; i++ {
+		all.Deps = append(all.Deps, &DepNode{
+			Output:  fmt.Sprintf("out/obj%d.o", i),
+			Cmds:    []string{fmt.Sprintf("gcc -c src/obj%d.c -o $@", i)},
+			Deps:    []*DepNode{{Output: fmt.Sprintf("src/obj%d.c", i)}},
+			HasRule: true,
+		})
+	}
+	g := &DepGraph{
+		nodes: []*DepNode{all},
+		vars: Vars{
+			"SHELL": &simpleVar{value: []string{"/bin/sh"}, origin: "file"},
+		},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := &NinjaGenerator{}
+		n.init(g)
+		err := n.generateNinja("all")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func loadMakefileForTest(t *testing.T, mk string, targets []string) *DepGraph {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	fn := filepath.Join(dir, "Makefile")
+	err := ioutil.WriteFile(fn, []byte(mk), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := Load(LoadReq{Makefile: fn, Targets: targets})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return g
+}
+
+func TestNinjaDefaultGoal(t *testing.T) {
+	g := loadMakefileForTest(t, `
+.DEFAULT_GOAL := release
+debug:
+	echo debug
+release:
+	echo release
+`, nil)
+	dt := defaultTarget(g, nil)
+	if dt != "release" {
+		t.Errorf("defaultTarget=%q; want=%q", dt, "release")
+	}
+	got := genNinjaForGraph(t, &NinjaGenerator{}, g, dt)
+	if want := "\ndefault release\n"; !strings.Contains(got, want) {
+		t.Errorf("output doesn't contain %q\n%s", want, got)
+	}
+}
+
+func TestNinjaDefaultTargetNotEmitted(t *testing.T) {
+	// ninja.go exists, so it is a source file without a build statement.
+	g := loadMakefileForTest(t, `
+all:
+	echo all
+`, []string{"ninja.go"})
+	n := &NinjaGenerator{}
+	got := genNinjaForGraph(t, n, g, "ninja.go")
+	if strings.Contains(got, "\ndefault ") {
+		t.Errorf("output has a default for a source file\n%s", got)
+	}
+	want := `default target "ninja.go" is not emitted: it is an existing file without a rule`
+	if msg := n.checkDefaultTarget("ninja.go"); msg != want {
+		t.Errorf("checkDefaultTarget(%q)=%q; want=%q", "ninja.go", msg, want)
+	}
+	if msg := n.checkDefaultTarget("all"); msg == "" {
+		t.Errorf("checkDefaultTarget(%q)=%q; want not reachable", "all", msg)
+	}
+
+	n = &NinjaGenerator{StrictDefaultTarget: true}
+	n.init(g)
+	n.f = &bytes.Buffer{}
+	if err := n.emitNinja("ninja.go"); err == nil || err.Error() != want {
+		t.Errorf("emitNinja with StrictDefaultTarget=%v; want %q", err, want)
+	}
+}
+
+func TestNinjaPool(t *testing.T) {
+	g := loadMakefileForTest(t, `
+all: menuconfig flash
+menuconfig: .KATI_NINJA_POOL := console
+menuconfig:
+	./menuconfig
+flash:
+	./flash
+`, []string{"all"})
+	got := genNinjaForGraph(t, &NinjaGenerator{}, g, "all")
+	if want := "build menuconfig: rule0\n pool = console\n"; !strings.Contains(got, want) {
+		t.Errorf("output doesn't contain %q\n%s", want, got)
+	}
+	if c := strings.Count(got, " pool = "); c != 1 {
+		t.Errorf("output has %d pools; want 1\n%s", c, got)
+	}
+
+	n := &NinjaGenerator{}
+	n.init(&DepGraph{
+		nodes: []*DepNode{{
+			Output:   "foo.o",
+			Cmds:     []string{"gcc -MD -c foo.c -o foo.o"},
+			HasRule:  true,
+			Pool:     "console",
+			Filename: "Makefile",
+			Lineno:   3,
+		}},
+		vars: Vars{"SHELL": &simpleVar{value: []string{"/bin/sh"}, origin: "file"}},
+	})
+	n.f = &bytes.Buffer{}
+	err := n.emitNinja("")
+	if err == nil {
+		t.Fatalf("emitNinja with console pool and depfile: no error")
+	}
+	if want := `Makefile:3: recipe for "foo.o": uses console pool with depfile "foo.d.tmp"`; err.Error() != want {
+		t.Errorf("emitNinja with console pool and depfile: %q; want=%q", err, want)
+	}
+}
+
+func TestPrepareCommands(t *testing.T) {
+	var mk bytes.Buffer
+	fmt.Fprintf(&mk, "all:")
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&mk, " out%d", i)
+	}
+	fmt.Fprintf(&mk, "\nFLAGS := -O2\n")
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&mk, "out%d: FLAGS += -DN=%d\nout%d: in%d\n\techo $(FLAGS) $< > $@\n", i, i, i, i)
+	}
+	g := loadMakefileForTest(t, mk.String(), []string{"all"})
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	n := &NinjaGenerator{}
+	n.init(g)
+	n.prepareCommands()
+	for _, node := range g.nodes[0].Deps {
+		want := n.newNinjaCommand(n.ctx, node)
+		got, ok := n.commands[node]
+		if !ok {
+			t.Errorf("command for %s is not prepared", node.Output)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("command for %s=%#v; want=%#v", node.Output, got, want)
+		}
+	}
+}
+
+func TestPrepareCommandsEnv(t *testing.T) {
+	defer withUsedEnvs()()
+	var mk bytes.Buffer
+	var envs []string
+	fmt.Fprintf(&mk, "all:")
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&mk, " out%d", i)
+	}
+	fmt.Fprintf(&mk, "\n")
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&mk, "out%d:\n\techo $(ENV%d) $(SHARED_ENV) > $@\n", i, i)
+		envs = append(envs, fmt.Sprintf("ENV%d=%d", i, i))
+	}
+	envs = append(envs, "SHARED_ENV=shared")
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	fn := filepath.Join(dir, "Makefile")
+	if err := ioutil.WriteFile(fn, mk.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	g, err := Load(LoadReq{Makefile: fn, Targets: []string{"all"}, EnvironmentVars: envs})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	n := &NinjaGenerator{}
+	n.init(g)
+	n.prepareCommands()
+	if len(n.commands) != 100 {
+		t.Errorf("%d commands are prepared; want=100", len(n.commands))
+	}
+	names := n.usedEnvNames()
+	if len(names) != 101 {
+		t.Errorf("used envs=%q; want 101 names", names)
+	}
+}
+
+func TestPrepareCommandsEval(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		def  string
+		cmd  string
+		// next is whether out1 sees LAST set by out0.
+		next bool
+	}{
+		{
+			name: "direct",
+			cmd:  "echo $(LAST)$(eval LAST := $@) > $@",
+			next: true,
+		},
+		{
+			name: "variable",
+			def:  "SET_LAST = $(eval LAST := $@)\nSET = $(SET_LAST)\n",
+			cmd:  "echo $(LAST)$(SET) > $@",
+			next: true,
+		},
+		{
+			name: "function",
+			def:  "SET_LAST = $(eval LAST := $(1))\n",
+			cmd:  "echo $(LAST)$(call SET_LAST,$@) > $@",
+			next: true,
+		},
+		{
+			name: "target specific",
+			def:  "out0: SET_LAST = $(eval LAST := $@)\n",
+			cmd:  "echo $(LAST)$(SET_LAST) > $@",
+			next: true,
+		},
+	} {
+		var mk bytes.Buffer
+		fmt.Fprintf(&mk, "all:")
+		for i := 0; i < 20; i++ {
+			fmt.Fprintf(&mk, " out%d", i)
+		}
+		fmt.Fprintf(&mk, "\n%s", tc.def)
+		for i := 0; i < 20; i++ {
+			fmt.Fprintf(&mk, "out%d:\n\t%s\n", i, tc.cmd)
+		}
+		gen := func(procs int) string {
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+			g := loadMakefileForTest(t, mk.String(), []string{"all"})
+			return genNinjaForGraph(t, &NinjaGenerator{}, g, "all")
+		}
+		g := loadMakefileForTest(t, mk.String(), []string{"all"})
+		n := &NinjaGenerator{}
+		n.init(g)
+		if !n.nodeUsesEval(g.nodes[0].Deps[0], make(map[string]bool)) {
+			t.Errorf("%s: eval in the recipe of out0 is not detected", tc.name)
+		}
+		serial := gen(1)
+		if tc.next && !strings.Contains(serial, "echo out0 > ${out}") {
+			t.Errorf("%s: eval in recipe doesn't reach next recipe\n%s", tc.name, serial)
+			continue
+		}
+		if got := gen(4); got != serial {
+			t.Errorf("%s: output with eval in recipes differs from serial run\n%s\n---\n%s", tc.name, got, serial)
+		}
+	}
+}
+
+func TestPrepareCommandsNoEval(t *testing.T) {
+	g := loadMakefileForTest(t, "FLAGS = $(filter-out -g,$(CFLAGS)) -DEVAL\nCFLAGS := -g -O2\nall: out\nout:\n\techo eval $(FLAGS) $(subst a,b,$@) > $@\n", []string{"all"})
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	n := &NinjaGenerator{}
+	n.init(g)
+	if n.nodeUsesEval(g.nodes[0].Deps[0], make(map[string]bool)) {
+		t.Errorf("recipe without eval is detected as eval")
+	}
+}
+
+func TestPrepareCommandsStop(t *testing.T) {
+	var mk bytes.Buffer
+	fmt.Fprintf(&mk, "all:")
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&mk, " out%d", i)
+	}
+	fmt.Fprintf(&mk, "\n")
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&mk, "out%d:\n\techo $(bad\n", i)
+	}
+	g := loadMakefileForTest(t, mk.String(), []string{"all"})
+	const numWorkers = 4
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(numWorkers))
+
+	n := &NinjaGenerator{}
+	n.init(g)
+	n.prepareCommands()
+	// each worker stops after its first error, and one more node may
+	// be sent before the error is noticed.
+	if len(n.commands) > numWorkers+1 {
+		t.Errorf("%d commands are prepared after errors; want <= %d", len(n.commands), numWorkers+1)
+	}
+
+	n = &NinjaGenerator{KeepGoing: true}
+	n.init(g)
+	n.prepareCommands()
+	if len(n.commands) != 100 {
+		t.Errorf("%d commands are prepared with KeepGoing; want=100", len(n.commands))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	n = &NinjaGenerator{}
+	n.init(g)
+	n.cancel = ctx
+	n.prepareCommands()
+	if len(n.commands) != 0 {
+		t.Errorf("%d commands are prepared after cancel; want=0", len(n.commands))
+	}
+}
+
+func TestWriteEnvJSON(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	fn := filepath.Join(dir, "env.json")
+	err := writeEnvJSON(fn, map[string]string{
+		"TARGET_PRODUCT": "aosp_arm",
+		"OUT_DIR":        `out "dir"`,
+	})
+	if err != nil {
+		t.Fatalf("writeEnvJSON: %v", err)
+	}
+	got, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "OUT_DIR": "out \"dir\"",
+  "TARGET_PRODUCT": "aosp_arm"
+}
+`
+	if string(got) != want {
+		t.Errorf("writeEnvJSON wrote %q; want %q", got, want)
+	}
+}
+
+func TestEscapeBuildTarget(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{in: "foo", want: "foo"},
+		{in: "a$b", want: "a$$b"},
+		{in: "a:b", want: "a$:b"},
+		{in: "a b", want: "a$ b"},
+		{in: `a\ b`, want: "a$ b"},
+		{in: "a#b", want: "a#b"},
+		{in: "#a", want: "#a"},
+		{in: "a\tb", want: "a\tb"},
+		{in: "a\nb", err: true},
+		{in: "a\rb", err: true},
+	} {
+		err := checkBuildTarget(tc.in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("checkBuildTarget(%q) unexpectedly has no error", tc.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("checkBuildTarget(%q)=%v", tc.in, err)
+		}
+		if got := escapeBuildTarget(tc.in); got != tc.want {
+			t.Errorf("escapeBuildTarget(%q)=%q; want=%q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestEmitDeepChain(t *testing.T) {
+	const depth = 100000
+	nodes := make([]*DepNode, depth)
+	for i := depth - 1; i >= 0; i-- {
+		nodes[i] = &DepNode{
+			Output:  fmt.Sprintf("out%d", i),
+			Cmds:    []string{fmt.Sprintf("touch out%d", i)},
+			HasRule: true,
+		}
+		if i+1 < depth {
+			nodes[i].Deps = []*DepNode{nodes[i+1]}
+		}
+	}
+	got := genNinjaForTest(t, &NinjaGenerator{}, nodes[:1], "out0")
+	if c := strings.Count(got, "\nbuild out"); c != depth {
+		t.Errorf("output has %d build statements; want %d", c, depth)
+	}
+	first := strings.Index(got, "\nbuild out0: ")
+	last := strings.Index(got, fmt.Sprintf("\nbuild out%d: ", depth-1))
+	if first < 0 || last < 0 || first > last {
+		t.Errorf("build statements are not emitted from the root; out0 at %d, out%d at %d", first, depth-1, last)
+	}
+}
+
+func TestNinjaPolicy(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	fn := filepath.Join(dir, "policy.json")
+	err := ioutil.WriteFile(fn, []byte(`[
+  {"glob": "out/*.stamp", "restat": true, "pool": "stamp_pool"},
+  {"glob": "out/*", "pool": "other_pool"}
+]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := loadMakefileForTest(t, `
+all: out/a.stamp out/b.stamp out/c.o
+out/b.stamp: .KATI_NINJA_POOL := console
+out/a.stamp out/b.stamp out/c.o:
+	touch $@
+`, []string{"all"})
+	got := genNinjaForGraph(t, &NinjaGenerator{PolicyPath: fn}, g, "all")
+	for _, tc := range []struct {
+		output string
+		restat bool
+		pool   string
+	}{
+		{output: "out/a.stamp", restat: true, pool: "stamp_pool"},
+		{output: "out/b.stamp", restat: true, pool: "console"},
+		{output: "out/c.o", pool: "other_pool"},
+	} {
+		i := strings.Index(got, fmt.Sprintf("# rule for %q\n", tc.output))
+		if i < 0 {
+			t.Errorf("no rule for %s\n%s", tc.output, got)
+			continue
+		}
+		block := got[i:]
+		want := fmt.Sprintf("\n pool = %s\n", tc.pool)
+		j := strings.Index(block, want)
+		if j < 0 {
+			t.Errorf("build %s: no %q\n%s", tc.output, want, block)
+			continue
+		}
+		block = block[:j]
+		if restat := strings.Contains(block, " restat = 1\n"); restat != tc.restat {
+			t.Errorf("build %s: restat=%t; want=%t\n%s", tc.output, restat, tc.restat, block)
+		}
+	}
+
+	err = ioutil.WriteFile(fn, []byte(`[{"glob": "*", "timeout": 10}]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &NinjaGenerator{PolicyPath: fn}
+	n.init(g)
+	n.f = &bytes.Buffer{}
+	if err := n.emitNinja("all"); err == nil {
+		t.Errorf("emitNinja with unknown policy attribute: no error")
+	}
+}
+
+func TestEmitNodeErrorPosition(t *testing.T) {
+	for _, tc := range []struct {
+		mk   string
+		want string
+	}{
+		{
+			mk:   "all: foo.o\nfoo.o:\n\tgcc -MD -MF a.d -MF b.d -c foo.c -o foo.o\n",
+			want: `Makefile:3: recipe for "foo.o": Multiple output file candidates`,
+		},
+		{
+			mk:   "all: foo.o\n\nfoo.o:\n\techo $(word 0,a)\n",
+			want: `Makefile:4: recipe for "foo.o": *** first argument to "word" function`,
+		},
+	} {
+		g := loadMakefileForTest(t, tc.mk, []string{"all"})
+		n := &NinjaGenerator{}
+		n.init(g)
+		n.f = &bytes.Buffer{}
+		err := n.emitNinja("all")
+		if err == nil {
+			t.Errorf("emitNinja for %q: no error", tc.mk)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("emitNinja for %q: %v; want %q", tc.mk, err, tc.want)
+		}
+	}
+}
+
+func TestNinjaOrderOnlyPrecedence(t *testing.T) {
+	g := loadMakefileForTest(t, `
+all: foo bar
+foo: | gen a
+foo: gen
+	touch $@
+bar: gen | b
+	touch $@
+gen a b:
+	touch $@
+`, []string{"all"})
+	got := genNinjaForGraph(t, &NinjaGenerator{}, g, "all")
+	for _, want := range []string{
+		"build foo: rule0 gen || a\n",
+		"build bar: rule3 gen || b\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output doesn't contain %q\n%s", want, got)
+		}
+	}
+}
+
+func TestNinjaFirstPrerequisite(t *testing.T) {
+	g := loadMakefileForTest(t, `
+all: one two
+one: a.c
+	cc -c $< -o $@
+two: a.c b.c
+	cc -c $< -o $@
+a.c b.c:
+`, []string{"all"})
+	got := genNinjaForGraph(t, &NinjaGenerator{}, g, "all")
+	for _, want := range []string{
+		// $< is the only input, so it is $in.
+		`command = /bin/sh -c "cc -c ${in} -o ${out}"`,
+		// the first of inputs is expanded when generated.
+		`command = /bin/sh -c "cc -c a.c -o ${out}"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output doesn't contain %q\n%s", want, got)
+		}
+	}
+}
+
+func TestNinjaAndroidRecipeConventions(t *testing.T) {
+	g := loadMakefileForTest(t, `
+hide := @
+PRIVATE_CFLAGS := -Oglobal
+all: a.o b.o
+a.o: PRIVATE_CFLAGS := -DA
+b.o: PRIVATE_CFLAGS := -DB
+a.o b.o:
+	$(hide)cc $(PRIVATE_CFLAGS) -c $(@:.o=.c) -o $@
+`, []string{"all"})
+	got := genNinjaForGraph(t, &NinjaGenerator{}, g, "all")
+	for _, want := range []string{
+		`command = /bin/sh -c "cc -DA -c a.c -o ${out}"`,
+		`command = /bin/sh -c "cc -DB -c b.c -o ${out}"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output doesn't contain %q\n%s", want, got)
+		}
+	}
+	for _, notWant := range []string{"@cc", "-Oglobal"} {
+		if strings.Contains(got, notWant) {
+			t.Errorf("output contains %q\n%s", notWant, got)
+		}
+	}
+}
+
+func TestNinjaVarsLongestFirst(t *testing.T) {
+	n := &NinjaGenerator{}
+	for _, tc := range []struct {
+		s       string
+		in, out string
+		want    string
+	}{
+		{s: "cp foobar foo", in: "foobar", out: "foo", want: "cp ${in} ${out}"},
+		{s: "cp foo foobar", in: "foo", out: "foobar", want: "cp ${in} ${out}"},
+		{s: "gen out/a out/a.d", in: "out/a", out: "out/a.d", want: "gen ${in} ${out}"},
+		{s: "touch foo", in: "", out: "foo", want: "touch ${out}"},
+	} {
+		nv := [][]string{
+			{"${in}", tc.in},
+			{"${out}", tc.out},
+		}
+		if got := n.ninjaVars(tc.s, nv, nil); got != tc.want {
+			t.Errorf("ninjaVars(%q, in=%q, out=%q)=%q; want=%q", tc.s, tc.in, tc.out, got, tc.want)
+		}
+	}
+}
+
+func TestNinjaVarsQuoted(t *testing.T) {
+	n := &NinjaGenerator{}
+	nv := [][]string{
+		{"${in}", "src/a.c"},
+		{"${out}", "out/a.o"},
+	}
+	for _, tc := range []struct {
+		s    string
+		esc  func(string) string
+		want string
+	}{
+		{
+			s:    `echo "building src/a.c" && cc -c src/a.c -o out/a.o`,
+			want: `echo "building src/a.c" && cc -c ${in} -o ${out}`,
+		},
+		{
+			s:    `echo 'src/a.c'; cp src/a.c out/a.o`,
+			want: `echo 'src/a.c'; cp ${in} ${out}`,
+		},
+		{
+			s:    `cp src/a.c.in out/a.o.tmp --out=out/a.o`,
+			want: `cp src/a.c.in out/a.o.tmp --out=${out}`,
+		},
+		{
+			s:    `(cat src/a.c|gzip)>out/a.o`,
+			want: `(cat ${in}|gzip)>${out}`,
+		},
+		{
+			s:    `echo "src/a.c" \" src/a.c > out/a.o`,
+			esc:  escapeShell,
+			want: `echo \"src/a.c\" \\\" ${in} > ${out}`,
+		},
+	} {
+		if got := n.ninjaVars(tc.s, nv, tc.esc); got != tc.want {
+			t.Errorf("ninjaVars(%q)=%q; want=%q", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestNinjaNonGCCDepfile(t *testing.T) {
+	g := loadMakefileForTest(t, `
+all: out/gen.h out/a.o
+out/gen.h:
+	mkdir -p out && tools/gen_deps -MD -MF out/gen.h.d -c gen.def -o $@
+out/a.o:
+	gcc -MD -MF out/a.o.d -c a.c -o $@
+`, []string{"all"})
+	got := genNinjaForGraph(t, &NinjaGenerator{NonGCCDepfileTools: []string{"gen_deps*"}}, g, "all")
+	for _, tc := range []struct {
+		output  string
+		depfile string
+		deps    bool
+	}{
+		{output: "out/gen.h", depfile: "out/gen.h.d.tmp"},
+		{output: "out/a.o", depfile: "out/a.o.d.tmp", deps: true},
+	} {
+		i := strings.Index(got, fmt.Sprintf("# rule for %q\n", tc.output))
+		if i < 0 {
+			t.Errorf("no rule for %s\n%s", tc.output, got)
+			continue
+		}
+		block := got[i:]
+		block = block[:strings.Index(block, "\nbuild ")]
+		if want := fmt.Sprintf(" depfile = %s\n", tc.depfile); !strings.Contains(block, want) {
+			t.Errorf("rule for %s doesn't contain %q\n%s", tc.output, want, block)
+		}
+		if deps := strings.Contains(block, " deps = gcc\n"); deps != tc.deps {
+			t.Errorf("rule for %s: deps = gcc is %t; want %t\n%s", tc.output, deps, tc.deps, block)
+		}
+	}
+}
+
+func TestNinjaDupBuild(t *testing.T) {
+	g := loadMakefileForTest(t, `
+all: gen.c gen.h
+gen.c: .KATI_IMPLICIT_OUTPUTS := gen.h
+gen.c:
+	./gen
+gen.h:
+	./gen_header
+`, []string{"all"})
+	for _, tc := range []struct {
+		version string
+		// want is the build statement of gen.h with AllowDupBuild.
+		want string
+	}{
+		{version: "", want: "\nbuild gen.h: phony gen.c\n"},
+		{version: "1.7", want: "\nbuild gen.c | gen.h: "},
+	} {
+		n := &NinjaGenerator{NinjaVersion: tc.version}
+		n.init(g)
+		n.f = &bytes.Buffer{}
+		err := n.emitNinja("all")
+		if err == nil || !strings.Contains(err.Error(), `multiple rules generate "gen.h": `) {
+			t.Errorf("emitNinja version=%q: %v; want multiple rules error", tc.version, err)
+		} else if !strings.Contains(err.Error(), "Makefile:5 and ") || !strings.Contains(err.Error(), "Makefile:7") {
+			t.Errorf("emitNinja version=%q: %v; want both rules", tc.version, err)
+		}
+
+		got := genNinjaForGraph(t, &NinjaGenerator{NinjaVersion: tc.version, AllowDupBuild: true}, g, "all")
+		if !strings.Contains(got, tc.want) {
+			t.Errorf("version=%q: output doesn't contain %q\n%s", tc.version, tc.want, got)
+		}
+		if strings.Contains(got, "gen_header") {
+			t.Errorf("version=%q: output has the ignored rule\n%s", tc.version, got)
+		}
+	}
+}
+
+func TestNinjaTargetNodes(t *testing.T) {
+	g := loadMakefileForTest(t, `
+all: foo bar
+foo: foo.c
+	cc -o $@ $<
+bar:
+	echo bar
+baz:
+	echo baz
+.PHONY: all baz
+`, nil)
+
+	nodes, err := targetNodes(g.nodes, []string{"foo"})
+	if err != nil {
+		t.Fatalf("targetNodes(g.nodes, [foo])=_, %v; want nil", err)
+	}
+	n := &NinjaGenerator{}
+	n.init(g)
+	n.nodes = nodes
+	var buf bytes.Buffer
+	n.f = &buf
+	if err := n.emitNinja(""); err != nil {
+		t.Fatalf("emitNinja: %v", err)
+	}
+	got := buf.String()
+	if !strings.Contains(got, "build foo: ") {
+		t.Errorf("output doesn't have foo\n%s", got)
+	}
+	for _, o := range []string{"all", "bar", "baz"} {
+		if strings.Contains(got, "build "+o+":") {
+			t.Errorf("output has %s, not needed by foo\n%s", o, got)
+		}
+	}
+
+	if got := genNinjaForGraph(t, &NinjaGenerator{}, g, ""); !strings.Contains(got, "build baz:") {
+		t.Errorf("whole graph doesn't have baz\n%s", got)
+	}
+
+	if _, err := targetNodes(g.nodes, []string{"nosuch"}); err == nil {
+		t.Errorf("targetNodes(g.nodes, [nosuch])=_, nil; want error")
+	}
+}
+
+func TestNinjaEmitted(t *testing.T) {
+	g := loadMakefileForTest(t, `
+all: foo bar
+foo: foo.c
+	cc -o $@ $<
+bar:
+	echo bar
+.PHONY: all
+`, nil)
+	n := &NinjaGenerator{}
+	genNinjaForGraph(t, n, g, "all")
+	want := []string{"all", "bar", "foo"}
+	if !reflect.DeepEqual(n.Emitted, want) {
+		t.Errorf("n.Emitted=%q; want %q", n.Emitted, want)
+	}
+}
+
+func TestNinjaOmitHeader(t *testing.T) {
+	defer inTempDir(t)()
+
+	g := &DepGraph{
+		nodes: []*DepNode{{Output: "all", HasRule: true, IsPhony: true}},
+		vars: Vars{
+			"SHELL": &simpleVar{value: []string{"/bin/sh"}, origin: "file"},
+		},
+		exports: map[string]bool{"B": true, "A": true, "C": false},
+	}
+	for _, omit := range []bool{false, true} {
+		n := &NinjaGenerator{OmitHeader: omit}
+		n.init(g)
+		err := n.generateShell()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.generateNinja("all")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{n.shName(), n.ninjaName()} {
+			b, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Contains(string(b), "# Generated by kati"); got == omit {
+				t.Errorf("OmitHeader=%t: %s has header=%t\n%s", omit, name, got, b)
+			}
+			if name == n.shName() && !strings.Contains(string(b), "export \"A\"=\"\"\nexport \"B\"=\"\"\nunset \"C\"\n") {
+				t.Errorf("%s doesn't have sorted exports\n%s", name, b)
+			}
+		}
+	}
+}
+
+func TestNinjaNotParallel(t *testing.T) {
+	for _, tc := range []struct {
+		mk     string
+		serial []string
+		pooled []string
+	}{
+		{
+			mk: `
+all: foo bar
+foo:
+	echo foo
+bar:
+	echo bar
+`,
+			pooled: []string{"all", "foo", "bar"},
+		},
+		{
+			mk: `
+all: foo bar
+foo:
+	echo foo
+bar:
+	echo bar
+.NOTPARALLEL:
+`,
+			serial: []string{"foo", "bar"},
+		},
+		{
+			mk: `
+all: foo bar baz
+foo: qux
+	echo foo
+bar:
+	echo bar
+baz:
+	echo baz
+qux:
+	echo qux
+.NOTPARALLEL: foo
+`,
+			serial: []string{"qux"},
+			pooled: []string{"foo", "bar", "baz"},
+		},
+	} {
+		g := loadMakefileForTest(t, tc.mk, nil)
+		got := genNinjaForGraph(t, &NinjaGenerator{}, g, "all")
+		if hasPool := strings.Contains(got, "pool serial_pool\n depth = 1\n"); hasPool != (len(tc.serial) > 0) {
+			t.Errorf("%s: has serial_pool=%t\n%s", tc.mk, hasPool, got)
+		}
+		for _, o := range tc.serial {
+			if !regexp.MustCompile(`(?m)^build ` + o + `: .*\n pool = serial_pool$`).MatchString(got) {
+				t.Errorf("%s: %s isn't in serial_pool\n%s", tc.mk, o, got)
+			}
+		}
+		for _, o := range tc.pooled {
+			if regexp.MustCompile(`(?m)^build ` + o + `: .*\n pool = serial_pool$`).MatchString(got) {
+				t.Errorf("%s: %s is in serial_pool\n%s", tc.mk, o, got)
+			}
+		}
+	}
+}
+
+func TestNinjaPhonyWithCommands(t *testing.T) {
+	defer inTempDir(t)()
+	err := ioutil.WriteFile("clean", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := loadMakefileForTest(t, `
+all: clean out
+clean:
+	rm -rf out
+out: in
+	cp in out
+in:
+.PHONY: all clean
+`, nil)
+	got := genNinjaForGraph(t, &NinjaGenerator{}, g, "all")
+	for _, want := range []string{
+		"build clean: rule0 | _kati_always_build_\n",
+		"build out: rule1 in\n",
+		"build all: phony clean out\n",
+		"build _kati_always_build_: phony\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output doesn't have %q\n%s", want, got)
+		}
+	}
+}
+
+func TestToolCategory(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: "prebuilts/clang/linux-x86/host/3.6/bin/clang -c foo.c -o foo.o", want: "CC"},
+		{in: "ccache gcc -c foo.c -o foo.o", want: "CC"},
+		{in: "mkdir -p out && (g++ -c foo.cc -o out/foo.o)", want: "CXX"},
+		{in: "gcc -c foo.cpp -o foo.o", want: "CXX"},
+		{in: "gcc -c foo.S -o foo.o", want: "AS"},
+		{in: "arm-linux-androideabi-as -o foo.o foo.s", want: "AS"},
+		{in: "g++ foo.o -o foo", want: "LD"},
+		{in: "arm-linux-androideabi-ld -o foo foo.o", want: "LD"},
+		{in: "rm -f libfoo.a && ar crsD libfoo.a foo.o", want: "AR"},
+		{in: "cp foo.c bar.c", want: ""},
+		{in: "gcc", want: ""},
+	} {
+		if got := toolCategory(tc.in); got != tc.want {
+			t.Errorf("toolCategory(%q)=%q; want=%q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestCategorizeDescriptions(t *testing.T) {
+	for _, tc := range []struct {
+		cmds []string
+		want string
+	}{
+		{cmds: []string{"gcc -c foo.c -o foo.o"}, want: "[CC] $out"},
+		{cmds: []string{"mkdir -p out", "g++ -c foo.cc -o out/foo.o"}, want: "[CXX] $out"},
+		{cmds: []string{"echo Compiling foo", "gcc -c foo.c -o foo.o"}, want: "Compiling foo"},
+		{cmds: []string{"cp foo bar"}, want: "build $out"},
+	} {
+		n := &NinjaGenerator{CategorizeDescriptions: true, DetectAndroidEcho: true}
+		var runners []runner
+		for _, cmd := range tc.cmds {
+			runners = append(runners, runner{cmd: cmd})
+		}
+		_, got, _ := n.genShellScript(runners)
+		if got != tc.want {
+			t.Errorf("genShellScript(%q) desc=%q; want=%q", tc.cmds, got, tc.want)
+		}
+	}
+}
+
+func TestReplaceNinjaOut(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: "build $out", want: "build foo.o"},
+		{in: "[CC] ${out}", want: "[CC] foo.o"},
+		{in: "$out $outx $$out $$$out", want: "foo.o $outx $$out $$foo.o"},
+		{in: "Compiling", want: "Compiling"},
+		{in: "cost $", want: "cost $"},
+	} {
+		if got := replaceNinjaOut(tc.in, "foo.o"); got != tc.want {
+			t.Errorf("replaceNinjaOut(%q, foo.o)=%q; want=%q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestNinjaDescriptionUseBasename(t *testing.T) {
+	nodes := []*DepNode{
+		{Output: "out/obj/foo.o", Cmds: []string{"gcc -c -o $@ foo.c"}, HasRule: true},
+	}
+	got := genNinjaForTest(t, &NinjaGenerator{DescriptionUseBasename: true}, nodes, "")
+	if want := " description = build foo.o\n"; !strings.Contains(got, want) {
+		t.Errorf("output doesn't contain %q\n%s", want, got)
+	}
+}
+
+func TestNinjaShowCommands(t *testing.T) {
+	for _, tc := range []struct {
+		cmds []string
+		want []string
+	}{
+		{
+			cmds: []string{"touch $@"},
+			want: []string{"rule rule0\n command = /bin/sh -c \"touch ${out}\"\n"},
+		},
+		{
+			cmds: []string{"echo Touching", "touch $@"},
+			want: []string{"rule rule0\n command = /bin/sh -c \"(echo Touching) && (touch ${out})\"\n"},
+		},
+		{
+			cmds: []string{"echo " + strings.Repeat("x", 100*1000)},
+			want: []string{
+				"rule rule0\n rspfile = $out.rsp\n",
+				" command = /bin/sh $out.rsp\n",
+			},
+		},
+	} {
+		node := &DepNode{
+			Output:  "out",
+			Cmds:    tc.cmds,
+			HasRule: true,
+		}
+		n := &NinjaGenerator{ShowCommands: true, DetectAndroidEcho: true}
+		got := genNinjaForTest(t, n, []*DepNode{node}, "")
+		if strings.Contains(got, " description = ") {
+			t.Errorf("output has a description\n%.1000s", got)
+		}
+		for _, w := range tc.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("output doesn't contain %q\n%.1000s", w, got)
+			}
+		}
+	}
+}
+
+func TestGomaCompileRE(t *testing.T) {
+	const cc = "ccache toolchain/bin/clang -c foo.c -o foo.o"
+	n := &NinjaGenerator{GomaDir: "/goma", GomaCompileRE: regexp.MustCompile(`^toolchain/bin/clang .*-c `)}
+	got, _, useLocalPool := n.genShellScript([]runner{{cmd: cc}})
+	if want := "/goma/gomacc toolchain/bin/clang -c foo.c -o foo.o"; got != want {
+		t.Errorf("genShellScript(%q)=%q; want=%q", cc, got, want)
+	}
+	if useLocalPool {
+		t.Errorf("genShellScript(%q) uses local_pool; want goma", cc)
+	}
+}
+
+func TestSplitEnvPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		env  string
+		rest string
+	}{
+		{in: "clang -c foo.c", rest: "clang -c foo.c"},
+		{in: "env FOO=bar clang -c foo.c", env: "env FOO=bar ", rest: "clang -c foo.c"},
+		{in: "/usr/bin/env FOO=bar BAZ='a b' clang -c foo.c", env: "/usr/bin/env FOO=bar BAZ='a b' ", rest: "clang -c foo.c"},
+		{in: "LC_ALL=C clang -c foo.c", env: "LC_ALL=C ", rest: "clang -c foo.c"},
+		{in: "env -i FOO=bar clang -c foo.c", rest: "env -i FOO=bar clang -c foo.c"},
+		{in: "clang -DFOO=bar -c foo.c", rest: "clang -DFOO=bar -c foo.c"},
+	} {
+		env, rest := splitEnvPrefix(tc.in)
+		if env != tc.env || rest != tc.rest {
+			t.Errorf("splitEnvPrefix(%q)=%q, %q; want=%q, %q", tc.in, env, rest, tc.env, tc.rest)
+		}
+	}
+}
+
+func TestGenShellScriptEnvPrefix(t *testing.T) {
+	const cc = "prebuilts/clang/linux-x86/host/3.6/bin/clang -c foo.c -o foo.o"
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: "env FOO=bar " + cc, want: "env FOO=bar /goma/gomacc " + cc},
+		{in: "FOO=bar ccache " + cc, want: "FOO=bar /goma/gomacc " + cc},
+		{in: "env -u FOO " + cc, want: "env -u FOO " + cc},
+	} {
+		n := &NinjaGenerator{GomaDir: "/goma"}
+		got, _, _ := n.genShellScript([]runner{{cmd: tc.in}})
+		if got != tc.want {
+			t.Errorf("genShellScript(%q)=%q; want=%q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestNinjaSplitDwarf(t *testing.T) {
+	for _, tc := range []struct {
+		cmds    []string
+		version string
+		want    []string
+		notWant []string
+	}{
+		{
+			cmds:    []string{"gcc -gsplit-dwarf -c foo.c -o $@"},
+			version: "1.7",
+			want:    []string{"build out/foo.o | out/foo.dwo: rule0\n"},
+		},
+		{
+			cmds:    []string{"mkdir -p out", "clang -c foo.c -gsplit-dwarf -o $@"},
+			version: "1.7",
+			want:    []string{"build out/foo.o | out/foo.dwo: rule0\n"},
+		},
+		{
+			cmds: []string{"gcc -gsplit-dwarf -c foo.c -o $@"},
+			want: []string{
+				"build out/foo.o: rule0\n",
+				"build out/foo.dwo: phony out/foo.o\n",
+			},
+		},
+		{
+			cmds:    []string{"clang --coverage -c foo.c -o $@"},
+			version: "1.7",
+			want:    []string{"build out/foo.o | out/foo.gcno: rule0\n"},
+		},
+		{
+			cmds:    []string{"gcc -fprofile-arcs -ftest-coverage --coverage -gsplit-dwarf -c foo.c -o $@"},
+			version: "1.7",
+			want:    []string{"build out/foo.o | out/foo.dwo out/foo.gcno: rule0\n"},
+		},
+		{
+			cmds:    []string{"gcc -c foo.c -o $@"},
+			version: "1.7",
+			want:    []string{"build out/foo.o: rule0\n"},
+			notWant: []string{".dwo", ".gcno"},
+		},
+	} {
+		node := &DepNode{
+			Output:  "out/foo.o",
+			Cmds:    tc.cmds,
+			HasRule: true,
+		}
+		got := genNinjaForTest(t, &NinjaGenerator{NinjaVersion: tc.version}, []*DepNode{node}, "")
+		for _, w := range tc.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("%q: output doesn't contain %q\n%s", tc.cmds, w, got)
+			}
+		}
+		for _, w := range tc.notWant {
+			if strings.Contains(got, w) {
+				t.Errorf("%q: output contains %q\n%s", tc.cmds, w, got)
+			}
+		}
+		if len(node.ImplicitOutputs) > 0 {
+			t.Errorf("%q: node.ImplicitOutputs=%q; want unchanged", tc.cmds, node.ImplicitOutputs)
+		}
+	}
+}
+
+func TestGenShellScriptHeredoc(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{
+			in:   "cat <<'EOF' > out \\\n\tfoo \\\n\tEOF",
+			want: "cat <<'EOF' > out \\\nfoo \\\nEOF",
+		},
+		{
+			in:   "echo '<<' \\\n\tfoo",
+			want: "echo '<<' foo",
+		},
+		{
+			in:   "cat <<< foo \\\n\tbar",
+			want: "cat <<< foo bar",
+		},
+	} {
+		n := &NinjaGenerator{}
+		got, _, _ := n.genShellScript([]runner{{cmd: tc.in}})
+		if got != tc.want {
+			t.Errorf("genShellScript(%q)=%q; want=%q", tc.in, got, tc.want)
+		}
+	}
+
+	node := &DepNode{
+		Output:  "out",
+		Cmds:    []string{"cat <<'EOF' > $@ \\\n\tfoo \\\n\tEOF"},
+		HasRule: true,
+	}
+	got := genNinjaForTest(t, &NinjaGenerator{}, []*DepNode{node}, "")
+	want := " command = " + shellNewlineVar + "/bin/sh -c \"cat <<'EOF' > ${out} \\\\$${kati_nl}foo \\\\$${kati_nl}EOF\"\n"
+	if !strings.Contains(got, want) {
+		t.Errorf("output doesn't contain %q\n%s", want, got)
+	}
+}
+
+func TestGenShellScriptContinuedComment(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: "echo foo \\\n\t# bar", want: "echo foo"},
+		{in: "echo foo\\\n\t#bar", want: "echo foo#bar"},
+		{in: "echo foo # bar \\\n\techo baz", want: "echo foo \n\techo baz"},
+	} {
+		n := &NinjaGenerator{}
+		got, _, _ := n.genShellScript([]runner{{cmd: tc.in}})
+		if got != tc.want {
+			t.Errorf("genShellScript(%q)=%q; want=%q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestGenShellScriptSubShell(t *testing.T) {
+	for _, tc := range []struct {
+		cmds []string
+		want string
+	}{
+		{cmds: []string{"(a)", "b"}, want: "(a) && (b)"},
+		{cmds: []string{"(a) | b", "c"}, want: "((a) | b) && (c)"},
+		{cmds: []string{"(a) || b", "c"}, want: "((a) || b) && (c)"},
+		{cmds: []string{"(a); (b)", "c"}, want: "((a); (b)) && (c)"},
+		{cmds: []string{"(echo ')') | b", "c"}, want: "((echo ')') | b) && (c)"},
+		{cmds: []string{"(cd x && (a))", "c"}, want: "(cd x && (a)) && (c)"},
+	} {
+		var runners []runner
+		for _, cmd := range tc.cmds {
+			runners = append(runners, runner{cmd: cmd})
+		}
+		n := &NinjaGenerator{}
+		got, _, _ := n.genShellScript(runners)
+		if got != tc.want {
+			t.Errorf("genShellScript(%q)=%q; want=%q", tc.cmds, got, tc.want)
+		}
+	}
+}
+
+func TestNinjaOneShell(t *testing.T) {
+	for _, tc := range []struct {
+		mk   string
+		want string
+	}{
+		{
+			mk: `
+out:
+	cd sub
+	touch $@
+`,
+			want: ` command = /bin/sh -c "(cd sub) && (touch ${out})"`,
+		},
+		{
+			mk: `
+.ONESHELL:
+out:
+	cd sub
+	touch $@
+`,
+			want: ` command = ` + shellNewlineVar + `/bin/sh -c "cd sub$${kati_nl}touch ${out}"`,
+		},
+		{
+			mk: `
+.ONESHELL:
+out:
+	-cd sub
+	touch $@
+`,
+			want: ` command = ` + shellNewlineVar + `/bin/sh -c "cd sub$${kati_nl}touch ${out}$${kati_nl}true"`,
+		},
+	} {
+		g := loadMakefileForTest(t, tc.mk, nil)
+		got := genNinjaForGraph(t, &NinjaGenerator{}, g, "out")
+		if !strings.Contains(got, tc.want+"\n") {
+			t.Errorf("%s: output doesn't contain %q\n%s", tc.mk, tc.want, got)
+		}
+	}
+}
+
+func TestNinjaShellFlags(t *testing.T) {
+	for _, tc := range []struct {
+		mk   string
+		want string
+	}{
+		{
+			mk: `
+out:
+	touch $@
+`,
+			want: ` command = /bin/sh -c "touch ${out}"`,
+		},
+		{
+			mk: `
+.SHELLFLAGS := -ec
+out:
+	touch $@
+`,
+			want: ` command = /bin/sh -ec "touch ${out}"`,
+		},
+		{
+			mk: `
+.SHELLFLAGS := -e -o pipefail -c
+out:
+	echo ` + strings.Repeat("x", 100*1000) + `
+`,
+			want: ` command = /bin/sh -e -o pipefail $out.rsp`,
+		},
+		{
+			mk: `
+.SHELLFLAGS := -ec
+out:
+	echo ` + strings.Repeat("x", 100*1000) + `
+`,
+			want: ` command = /bin/sh -e $out.rsp`,
+		},
+	} {
+		g := loadMakefileForTest(t, tc.mk, nil)
+		got := genNinjaForGraph(t, &NinjaGenerator{}, g, "out")
+		if !strings.Contains(got, tc.want+"\n") {
+			t.Errorf("%.100s: output doesn't contain %q\n%.1000s", tc.mk, tc.want, got)
+		}
+	}
+}
+
+func TestDeleteOnErrorCmd(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	out := filepath.Join(dir, "out")
+	for _, tc := range []struct {
+		cmd    string
+		status int
+		exists bool
+	}{
+		{cmd: "echo foo > " + out, exists: true},
+		{cmd: "echo foo > " + out + " && exit 3", status: 3},
+		{cmd: "(echo foo > " + out + ") ; true", exists: true},
+	} {
+		os.Remove(out)
+		cmdline := deleteOnErrorCmd(escapeNinja(tc.cmd), []string{out})
+		// as ninja runs it.
+		cmd := exec.Command("/bin/sh", "-c", strings.Replace(cmdline, "$$", "$", -1))
+		err := cmd.Run()
+		if got := exitStatus(err); got != tc.status {
+			t.Errorf("%q: exit status=%d; want=%d", cmdline, got, tc.status)
+		}
+		if _, err := os.Stat(out); (err == nil) != tc.exists {
+			t.Errorf("%q: %s exists=%t; want=%t", cmdline, out, err == nil, tc.exists)
+		}
+	}
+}
+
+func TestNinjaDeleteOnError(t *testing.T) {
+	for _, tc := range []struct {
+		mk   string
+		want string
+	}{
+		{
+			mk: `
+out:
+	touch $@
+`,
+			want: ` command = /bin/sh -c "touch ${out}"`,
+		},
+		{
+			mk: `
+.DELETE_ON_ERROR:
+out:
+	touch $@
+all: out
+	echo done
+.PHONY: all
+`,
+			want: ` command = /bin/sh -c '(touch ${out}) || { st=$$?; rm -f ${out}; exit $$st; }'`,
+		},
+	} {
+		g := loadMakefileForTest(t, tc.mk, nil)
+		got := genNinjaForGraph(t, &NinjaGenerator{}, g, "out")
+		if !strings.Contains(got, tc.want+"\n") {
+			t.Errorf("%s: output doesn't contain %q\n%s", tc.mk, tc.want, got)
+		}
+		if strings.Contains(got, "(echo done) ||") {
+			t.Errorf("%s: output removes outputs of phony targets\n%s", tc.mk, got)
+		}
+	}
+}
+
+func TestGenerateMakefileWrapper(t *testing.T) {
+	defer inTempDir(t)()
+
+	n := &NinjaGenerator{Suffix: "-foo", EmitMakefileWrapper: true}
+	for i := 0; i < 2; i++ {
+		// the wrapper of kati is overwritten.
+		err := n.generateMakefileWrapper()
+		if err != nil {
+			t.Fatalf("generateMakefileWrapper()=%v; want nil", err)
+		}
+	}
+	b, err := ioutil.ReadFile("Makefile-foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		makefileWrapperMarker + "\n",
+		"kati_default:\n\t@./ninja-foo.sh\n",
+		"Makefile-foo: ;\n",
+		"%:\n\t@./ninja-foo.sh $@\n",
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("Makefile-foo doesn't contain %q\n%s", want, b)
+		}
+	}
+
+	err = ioutil.WriteFile("Makefile", []byte("all:\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n = &NinjaGenerator{EmitMakefileWrapper: true}
+	if err := n.generateMakefileWrapper(); err == nil {
+		t.Errorf("generateMakefileWrapper()=nil; want error for existing Makefile")
+	}
+	if b, _ := ioutil.ReadFile("Makefile"); string(b) != "all:\n" {
+		t.Errorf("Makefile=%q; want unchanged", b)
+	}
+}
+
+func TestEmitRegenRulesQuotedArgs(t *testing.T) {
+	n := &NinjaGenerator{
+		Args: []string{"kati", "--ninja", "--flag=some value", "FOO=$(BAR)", "it's"},
+	}
+	g := &DepGraph{vars: make(Vars)}
+	n.init(g)
+	var buf bytes.Buffer
+	n.f = &buf
+	err := n.emitRegenRules()
+	if err != nil {
+		t.Fatalf("emitRegenRules: %v", err)
+	}
+	got := buf.String()
+	if want := ` command=kati --ninja '--flag=some value' 'FOO=$$(BAR)' 'it'\''s'` + "\n"; !strings.Contains(got, want) {
+		t.Errorf("regen rule doesn't contain %q\n%s", want, got)
+	}
+}
+
+func TestNinjaManyEnvs(t *testing.T) {
+	defer inTempDir(t)()
+
+	defer withUsedEnvs()()
+	vars := make(Vars)
+	const numEnvs = 20000
+	for i := 0; i < numEnvs; i++ {
+		name := fmt.Sprintf("KATI_TEST_ENV_%05d", i)
+		usedEnvs[name] = true
+		vars[name] = &simpleVar{value: []string{strings.Repeat("v", 64)}, origin: "environment"}
+	}
+	g := &DepGraph{
+		nodes: []*DepNode{{Output: "all", HasRule: true, IsPhony: true}},
+		vars:  vars,
+	}
+	n := &NinjaGenerator{Args: []string{"kati", "--ninja"}}
+	n.init(g)
+	err := n.generateEnvlist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(n.envlistName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(b), "\n"); got != numEnvs {
+		t.Errorf("%s has %d lines; want %d", n.envlistName(), got, numEnvs)
+	}
+	// The env list is written by kati itself, so no command line in
+	// the ninja file grows with the number of used variables.
+	got := genNinjaForGraph(t, n, g, "all")
+	for _, line := range strings.Split(got, "\n") {
+		if len(line) > 4096 {
+			t.Errorf("too long line in ninja file: %.80q...", line)
+		}
+	}
+	if want := "build build.ninja: regen_ninja .kati_env\n"; !strings.Contains(got, want) {
+		t.Errorf("regen rule doesn't contain %q", want)
+	}
+}
+
+func TestGenerateEnvlistSorted(t *testing.T) {
+	defer inTempDir(t)()
+
+	defer withUsedEnvs()()
+	vars := make(Vars)
+	for _, name := range []string{"ZETA", "ALPHA", "MID", "BETA"} {
+		usedEnvs[name] = true
+		vars[name] = &simpleVar{value: []string{strings.ToLower(name)}, origin: "environment"}
+	}
+	g := &DepGraph{vars: vars}
+	want := "\"ALPHA\"=\"alpha\"\n\"BETA\"=\"beta\"\n\"MID\"=\"mid\"\n\"ZETA\"=\"zeta\"\n"
+	for i := 0; i < 10; i++ {
+		n := &NinjaGenerator{}
+		n.init(g)
+		err := n.generateEnvlist()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(n.envlistName())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Fatalf("%s=%q; want %q", n.envlistName(), b, want)
+		}
+	}
+}
+
+func TestNinjaEnvBackslash(t *testing.T) {
+	defer inTempDir(t)()
+
+	defer withUsedEnvs("WIN_PATH")()
+	g := &DepGraph{
+		nodes: []*DepNode{{Output: "all", HasRule: true, IsPhony: true}},
+		vars: Vars{
+			"WIN_PATH": &simpleVar{value: []string{`C:\tmp\n`}, origin: "environment"},
+		},
+	}
+	n := &NinjaGenerator{Args: []string{"kati", "--ninja"}}
+	n.init(g)
+	err := n.generateEnvlist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(n.envlistName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `"WIN_PATH"="C:\\tmp\\n"` + "\n"
+	if string(b) != want {
+		t.Errorf("%s=%q; want %q", n.envlistName(), b, want)
+	}
+	// The ninja file records the value the same way as the env list.
+	got := genNinjaForGraph(t, n, g, "all")
+	if !strings.Contains(got, "# "+want) {
+		t.Errorf("ninja file doesn't contain %q\n%s", "# "+want, got)
+	}
+}
+
+func TestEmitRegenRulesDepfile(t *testing.T) {
+	n := &NinjaGenerator{Args: []string{"kati", "--ninja"}}
+	n.init(&DepGraph{vars: make(Vars)})
+	var buf bytes.Buffer
+	n.f = &buf
+	err := n.emitRegenRules()
+	if err != nil {
+		t.Fatalf("emitRegenRules: %v", err)
+	}
+	got := buf.String()
+	if want := " depfile = build.ninja.d\n"; !strings.Contains(got, want) {
+		t.Errorf("regen rule doesn't contain %q\n%s", want, got)
+	}
+	// ninja would move the depfile into its deps log, which a manual
+	// run of kati doesn't update.
+	if strings.Contains(got, "deps = ") {
+		t.Errorf("regen rule has deps\n%s", got)
+	}
+}
+
+func TestEmitRegenRulesSpacedMakefile(t *testing.T) {
+	n := &NinjaGenerator{Args: []string{"kati", "--ninja"}}
+	g := &DepGraph{
+		vars: Vars{
+			"MAKEFILE_LIST": &simpleVar{value: []string{` Makefile my\ dir/foo.mk  a:b.mk`}, origin: "file"},
+		},
+	}
+	n.init(g)
+	var buf bytes.Buffer
+	n.f = &buf
+	err := n.emitRegenRules()
+	if err != nil {
+		t.Fatalf("emitRegenRules: %v", err)
+	}
+	got := buf.String()
+	if want := "build build.ninja: regen_ninja Makefile my$ dir/foo.mk a$:b.mk\n"; !strings.Contains(got, want) {
+		t.Errorf("regen rule doesn't contain %q\n%s", want, got)
+	}
+}
+
+func TestNinjaCommandHook(t *testing.T) {
+	nodes := []*DepNode{
+		{Output: "out/foo.o", Cmds: []string{"/src/prebuilts/clang -c foo.c -o $@"}, HasRule: true},
+		{Output: "bar.o", Cmds: []string{"/src/prebuilts/clang -c bar.c -o $@"}, HasRule: true},
+	}
+	n := &NinjaGenerator{
+		CommandHook: func(node *DepNode, cmd string) string {
+			if !strings.HasPrefix(node.Output, "out/") {
+				return cmd
+			}
+			return strings.Replace(cmd, "/src/", "", -1)
+		},
+	}
+	got := genNinjaForTest(t, n, nodes, "")
+	for _, want := range []string{
+		` command = /bin/sh -c "prebuilts/clang -c foo.c -o ${out}"`,
+		` command = /bin/sh -c "/src/prebuilts/clang -c bar.c -o ${out}"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output doesn't contain %q\n%s", want, got)
+		}
+	}
+}
+
+func TestNinjaCollapsePhonyChains(t *testing.T) {
+	g := loadMakefileForTest(t, `.PHONY: a b c d
+a: b
+b: c
+c: out
+d: b out
+out:
+	touch $@
+`, []string{"a", "d"})
+	for _, tc := range []struct {
+		collapse bool
+		want     []string
+	}{
+		{
+			want: []string{
+				"build a: phony b\n",
+				"build b: phony c\n",
+				"build c: phony out\n",
+				"build d: phony b out\n",
+			},
+		},
+		{
+			collapse: true,
+			want: []string{
+				"build a: phony out\n",
+				"build b: phony out\n",
+				"build c: phony out\n",
+				"build d: phony b out\n",
+			},
+		},
+	} {
+		got := genNinjaForGraph(t, &NinjaGenerator{CollapsePhonyChains: tc.collapse}, g, "a")
+		for _, w := range tc.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("CollapsePhonyChains=%t: output doesn't contain %q\n%s", tc.collapse, w, got)
+			}
+		}
+		if !strings.Contains(got, "\nbuild out: rule0\n") {
+			t.Errorf("CollapsePhonyChains=%t: out is not built\n%s", tc.collapse, got)
+		}
+	}
+}
+
+func TestNinjaKeepGoing(t *testing.T) {
+	bad1 := &DepNode{Output: "bad1.o", Cmds: []string{"gcc -MD -c bad1.c -o bad1.o -o x.o"}, HasRule: true}
+	bad2 := &DepNode{Output: "bad2.o", Cmds: []string{"gcc -MD -c bad2.c -o bad2.o -o y.o"}, HasRule: true, Package: "pkg"}
+	good := &DepNode{Output: "good.o", Cmds: []string{"gcc -c good.c -o good.o"}, HasRule: true}
+	all := &DepNode{Output: "all", Deps: []*DepNode{bad1, bad2, good}, HasRule: true, IsPhony: true}
+	n := &NinjaGenerator{KeepGoing: true}
+	got := genNinjaForTest(t, n, []*DepNode{all}, "all")
+	for _, want := range []string{
+		"rule kati_error\n",
+		"\nbuild bad1.o: kati_error\n msg = 'kati: recipe for \"bad1.o\": Multiple output file candidates in ",
+		"\nbuild bad2.o: kati_error\n",
+		"\nbuild good.o: rule",
+		"\nbuild all: phony bad1.o bad2.o good.o\n",
+		"\ndefault all\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output doesn't contain %q\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, `# rule for "bad1.o"`) {
+		t.Errorf("output has the rule of bad1.o\n%s", got)
+	}
+	if len(n.pkgs) != 0 {
+		t.Errorf("n.pkgs=%v; want no packages", n.pkgs)
+	}
+	if len(n.nodeErrs) != 2 {
+		t.Fatalf("n.nodeErrs=%v; want 2 errors", n.nodeErrs)
+	}
+	msg := n.nodeErrs.Error()
+	for _, want := range []string{"2 node(s) failed:\n", `"bad1.o"`, `"bad2.o"`} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("error %q doesn't contain %q", msg, want)
+		}
+	}
+
+	n = &NinjaGenerator{}
+	n.init(&DepGraph{
+		nodes: []*DepNode{all},
+		vars: Vars{
+			"SHELL": &simpleVar{value: []string{"/bin/sh"}, origin: "file"},
+		},
+	})
+	n.f = ioutil.Discard
+	err := n.emitNinja("all")
+	if err == nil {
+		t.Errorf("emitNinja without KeepGoing succeeded; want error")
+	}
+}
+
+// checkNinjaSyntax reports lines of s which ninja can't parse as a
+// declaration, a binding or a comment.
+func checkNinjaSyntax(t *testing.T, s string) {
+	for i, line := range strings.Split(s, "\n") {
+		switch {
+		case line == "", strings.HasPrefix(line, "#"), strings.HasPrefix(line, " "):
+			continue
+		}
+		word := line
+		if j := strings.IndexByte(line, ' '); j >= 0 {
+			word = line[:j]
+		}
+		switch word {
+		case "rule", "build", "default", "pool", "include", "subninja":
+			continue
+		}
+		if strings.HasPrefix(line[len(word):], " = ") {
+			continue
+		}
+		t.Errorf("line %d: unparsable %q\n%s", i+1, line, s)
+	}
+}
+
+func TestNinjaKeepGoingBadTarget(t *testing.T) {
+	nl := &DepNode{Output: "foo\nbar", Cmds: []string{"echo > $@"}, HasRule: true}
+	console := &DepNode{Output: "x.o", ImplicitOutputs: []string{"x.stamp"}, Cmds: []string{"gcc -MD -c x.c -o x.o"}, HasRule: true, Pool: "console"}
+	stamp := &DepNode{Output: "x.stamp", Cmds: []string{"touch $@"}, HasRule: true}
+	nlDep := &DepNode{Output: "baz\nqux", Filename: "Makefile", Lineno: 4}
+	bad := &DepNode{Output: "bad", Deps: []*DepNode{nlDep}, Cmds: []string{"touch $@"}, HasRule: true}
+	all := &DepNode{Output: "all", Deps: []*DepNode{nl, console, stamp, bad}, HasRule: true, IsPhony: true}
+	n := &NinjaGenerator{KeepGoing: true}
+	got := genNinjaForTest(t, n, []*DepNode{all}, "all")
+	checkNinjaSyntax(t, got)
+	for _, want := range []string{
+		"\nbuild all: kati_error\n",
+		"\nbuild x.o: kati_error\n",
+		"\nbuild x.stamp: rule",
+		"\nbuild bad: kati_error\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output doesn't contain %q\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "foo\n") || strings.Contains(got, "baz\n") {
+		t.Errorf("output has targets with a newline\n%s", got)
+	}
+	if len(n.nodeErrs) != 4 {
+		t.Errorf("n.nodeErrs=%v; want 4 errors", n.nodeErrs)
+	}
+	for _, o := range n.Emitted {
+		if o == "x.stamp" {
+			return
+		}
+	}
+	t.Errorf("n.Emitted=%q; want x.stamp", n.Emitted)
+}
+
+func TestNinjaKeepGoingDupBuild(t *testing.T) {
+	x := &DepNode{Output: "x", Cmds: []string{"touch $@"}, HasRule: true}
+	dotX := &DepNode{Output: "./x", Cmds: []string{"touch $@"}, HasRule: true}
+	all := &DepNode{Output: "all", Deps: []*DepNode{x, dotX}, HasRule: true, IsPhony: true}
+	n := &NinjaGenerator{KeepGoing: true}
+	got := genNinjaForTest(t, n, []*DepNode{all}, "all")
+	checkNinjaSyntax(t, got)
+	if strings.Contains(got, "build ./x") {
+		t.Errorf("output has a duplicated build statement for ./x\n%s", got)
+	}
+	if c := strings.Count(got, "\nbuild x:"); c != 1 {
+		t.Errorf("output has %d build statements for x; want 1\n%s", c, got)
+	}
+	if len(n.nodeErrs) != 1 || !strings.Contains(n.nodeErrs.Error(), "multiple rules generate") {
+		t.Errorf("n.nodeErrs=%v; want an error of multiple rules", n.nodeErrs)
+	}
+}
+
+func TestNinjaErrorOnMissingInput(t *testing.T) {
+	for _, tc := range []struct {
+		mk      string
+		wantErr string
+	}{
+		{
+			mk:      "all: foo.o\nfoo.o: ninja.go typo.h\n\ttouch $@\n",
+			wantErr: `Makefile:3: *** No rule to make target "typo.h", needed by "foo.o".`,
+		},
+		{
+			mk: ".PHONY: clean\nall: clean ninja.go force\nclean:\nforce:\n",
+		},
+	} {
+		g := loadMakefileForTest(t, tc.mk, []string{"all"})
+		for _, strict := range []bool{false, true} {
+			n := &NinjaGenerator{ErrorOnMissingInput: strict}
+			n.init(g)
+			n.f = ioutil.Discard
+			err := n.emitNinja("all")
+			if !strict || tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("%q: ErrorOnMissingInput=%t: %v", tc.mk, strict, err)
+				}
+				continue
+			}
+			if err == nil || !strings.HasSuffix(err.Error(), tc.wantErr) {
+				t.Errorf("%q: err=%v; want %q", tc.mk, err, tc.wantErr)
+			}
+		}
+	}
+}
+
+func TestSaveContextCanceled(t *testing.T) {
+	defer inTempDir(t)()
+
+	g := &DepGraph{
+		nodes: []*DepNode{{Output: "all", Cmds: []string{"touch $@"}, HasRule: true}},
+		vars: Vars{
+			"SHELL": &simpleVar{value: []string{"/bin/sh"}, origin: "file"},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	n := &NinjaGenerator{}
+	err := n.SaveContext(ctx, g, "", nil)
+	if err != context.Canceled {
+		t.Errorf("SaveContext with canceled context=%v; want %v", err, context.Canceled)
+	}
+	if _, err := os.Stat(n.ninjaName()); !os.IsNotExist(err) {
+		t.Errorf("%s exists after cancel: %v", n.ninjaName(), err)
+	}
+	files, err := filepath.Glob("*" + n.ninjaName() + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) > 0 {
+		t.Errorf("partial files are left: %q", files)
+	}
+
+	err = n.Save(g, "", nil)
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if _, err := os.Stat(n.ninjaName()); err != nil {
+		t.Errorf("Save: %v", err)
+	}
+}
+
+func TestNinjaProgress(t *testing.T) {
+	var nodes []*DepNode
+	for i := 0; i < 2500; i++ {
+		nodes = append(nodes, &DepNode{Output: fmt.Sprintf("t%d", i), HasRule: true, IsPhony: true})
+	}
+	type call struct{ done, total int }
+	var got []call
+	n := &NinjaGenerator{
+		Progress: func(done, total int) {
+			got = append(got, call{done, total})
+		},
+	}
+	genNinjaForTest(t, n, nodes, "")
+	want := []call{{1000, 2500}, {2000, 2500}, {2500, 2500}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Progress is called with %v; want %v", got, want)
+	}
+}
+
+func TestNinjaOutDir(t *testing.T) {
+	defer inTempDir(t)()
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := &DepGraph{
+		nodes: []*DepNode{{Output: "all", Cmds: []string{"touch $@"}, HasRule: true, Package: "pkg"}},
+		vars: Vars{
+			"SHELL":         &simpleVar{value: []string{"/bin/sh"}, origin: "file"},
+			"MAKEFILE_LIST": &simpleVar{value: []string{"Makefile"}, origin: "file"},
+		},
+	}
+	n := &NinjaGenerator{
+		Args:                []string{"kati", "--ninja"},
+		Suffix:              "-x",
+		OutDir:              "out/kati",
+		EmitMakefileWrapper: true,
+	}
+	err = n.Save(g, "", nil)
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	for _, name := range []string{
+		"out/kati/build-x.ninja",
+		"out/kati/build-x.ninja.d",
+		"out/kati/ninja-x.sh",
+		"out/kati/.kati_env-x",
+		"out/kati/build-x.packages/pkg.ninja",
+		"Makefile-x",
+	} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("%s is not written: %v", name, err)
+		}
+	}
+	b, err := ioutil.ReadFile("out/kati/build-x.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"\nbuild out/kati/build-x.ninja: regen_ninja Makefile\n",
+		" depfile = out/kati/build-x.ninja.d\n",
+		"\nsubninja out/kati/build-x.packages/pkg.ninja\n",
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("ninja file doesn't contain %q\n%s", want, b)
+		}
+	}
+
+	// a fake ninja shows where and how ninja.sh runs it.
+	err = os.Mkdir("bin", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile("bin/ninja", []byte("#!/bin/sh\necho \"$PWD $*\"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("/bin/sh", "../out/kati/ninja-x.sh", "all")
+	cmd.Dir = filepath.Join(dir, "bin")
+	cmd.Env = append(os.Environ(), "PATH="+filepath.Join(dir, "bin")+":/usr/bin:/bin")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("ninja-x.sh: %v\n%s", err, out)
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the empty env list makes "export" print the environment first.
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if got, want := lines[len(lines)-1], root+" -f out/kati/build-x.ninja all"; got != want {
+		t.Errorf("ninja-x.sh runs %q; want %q", got, want)
+	}
+}
+
+func TestDetectGoma(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	for _, d := range []string{"goma", "bin", "empty"} {
+		err := os.Mkdir(filepath.Join(dir, d), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []string{"goma", "bin"} {
+		err := ioutil.WriteFile(filepath.Join(dir, d, "gomacc"), []byte("#!/bin/sh\n"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"GOMA_DIR", "PATH"} {
+		defer os.Setenv(name, os.Getenv(name))
+	}
+	for _, tc := range []struct {
+		gomaDir string
+		path    string
+		want    string
+	}{
+		{
+			gomaDir: filepath.Join(dir, "goma"),
+			path:    filepath.Join(dir, "bin"),
+			want:    filepath.Join(dir, "goma"),
+		},
+		{
+			gomaDir: filepath.Join(dir, "empty"),
+			path:    filepath.Join(dir, "bin"),
+			want:    filepath.Join(dir, "bin"),
+		},
+		{
+			path: filepath.Join(dir, "bin"),
+			want: filepath.Join(dir, "bin"),
+		},
+		{
+			gomaDir: filepath.Join(dir, "empty"),
+			path:    filepath.Join(dir, "empty"),
+			want:    "",
+		},
+	} {
+		os.Setenv("GOMA_DIR", tc.gomaDir)
+		os.Setenv("PATH", tc.path)
+		if got := DetectGoma(); got != tc.want {
+			t.Errorf("DetectGoma() with GOMA_DIR=%q PATH=%q=%q; want %q", tc.gomaDir, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestNinjaKatiDescription(t *testing.T) {
+	g := loadMakefileForTest(t, `
+all: foo bar
+foo: .KATI_DESCRIPTION := Generating foo for 100$$
+foo:
+	echo Compiling foo
+	touch $@
+bar:
+	echo Compiling bar
+	touch $@
+`, []string{"all"})
+	for _, node := range g.nodes[0].Deps {
+		if node.Output == "foo" && node.Description != "Generating foo for 100$" {
+			t.Errorf("foo.Description=%q; want %q", node.Description, "Generating foo for 100$")
+		}
+	}
+	for _, echo := range []bool{false, true} {
+		got := genNinjaForGraph(t, &NinjaGenerator{DetectAndroidEcho: echo}, g, "all")
+		want := []string{
+			"# rule for \"foo\"\nrule rule0\n description = Generating foo for 100$$\n",
+			"# rule for \"bar\"\nrule rule1\n description = build $out\n",
+		}
+		if echo {
+			want[1] = "# rule for \"bar\"\nrule rule1\n description = Compiling bar\n"
+		}
+		for _, w := range want {
+			if !strings.Contains(got, w) {
+				t.Errorf("DetectAndroidEcho=%t: output doesn't contain %q\n%s", echo, w, got)
+			}
+		}
+	}
+}
+
+func TestNinjaKatiGenerator(t *testing.T) {
+	g := loadMakefileForTest(t, `
+all: config.h foo
+config.h: .KATI_GENERATOR := true
+config.h:
+	./configure > $@
+foo:
+	touch $@
+`, []string{"all"})
+	got := genNinjaForGraph(t, &NinjaGenerator{}, g, "all")
+	if want := "# rule for \"config.h\"\nrule rule0\n description = build $out\n generator = 1\n"; !strings.Contains(got, want) {
+		t.Errorf("output doesn't contain %q\n%s", want, got)
+	}
+	if n := strings.Count(got, " generator = 1\n"); n != 1 {
+		t.Errorf("output has %d generator rules; want 1\n%s", n, got)
+	}
+}
+
+func TestEscapeShellBang(t *testing.T) {
+	for _, cmd := range []string{
+		`echo "hi!"`,
+		`echo 'a!b'`,
+		`echo a\!b`,
+		`[ ! -f /nonexistent ] && echo "no file!"`,
+		`x=1; echo "!$x!"`,
+	} {
+		want, err := exec.Command("/bin/sh", "-c", cmd).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%q: %v\n%s", cmd, err, want)
+		}
+		// ninja runs the command line with /bin/sh -c, after it
+		// unescapes $$.
+		cmdline := `/bin/sh -c "` + escapeShell(escapeNinja(cmd)) + `"`
+		cmdline = strings.Replace(cmdline, "$$", "$", -1)
+		got, err := exec.Command("/bin/sh", "-c", cmdline).CombinedOutput()
+		if err != nil {
+			t.Errorf("%q: %v\n%s", cmdline, err, got)
+			continue
+		}
+		if string(got) != string(want) {
+			t.Errorf("%q prints %q; want %q", cmdline, got, want)
+		}
+	}
+}
+
+func TestNinjaSingleQuoteCommand(t *testing.T) {
+	for _, tc := range []struct {
+		cmd  string
+		want string
+	}{
+		{
+			cmd:  "echo done",
+			want: `/bin/sh -c "echo done"`,
+		},
+		{
+			cmd:  `x=1; echo "a  b" $$x \"c\" ` + "`echo d`",
+			want: `/bin/sh -c 'x=1; echo "a  b" $$x \"c\" ` + "`echo d`'",
+		},
+		{
+			cmd:  `x=1; echo 'a  b' "$$x"`,
+			want: `/bin/sh -c "x=1; echo 'a  b' \"\$$x\""`,
+		},
+	} {
+		node := &DepNode{Output: "out", Cmds: []string{tc.cmd}, HasRule: true}
+		got := genNinjaForTest(t, &NinjaGenerator{}, []*DepNode{node}, "")
+		if !strings.Contains(got, " command = "+tc.want+"\n") {
+			t.Errorf("%q: output doesn't contain %q\n%s", tc.cmd, tc.want, got)
+			continue
+		}
+		// ninja runs the command line with /bin/sh -c, after it
+		// unescapes $$.
+		cmdline := strings.Replace(tc.want, "$$", "$", -1)
+		out, err := exec.Command("/bin/sh", "-c", cmdline).CombinedOutput()
+		if err != nil {
+			t.Errorf("%q: %v\n%s", cmdline, err, out)
+			continue
+		}
+		want, err := exec.Command("/bin/sh", "-c", strings.Replace(tc.cmd, "$$", "$", -1)).CombinedOutput()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != string(want) {
+			t.Errorf("%q prints %q; want %q", cmdline, out, want)
+		}
+	}
+}
+
+func TestNinjaRspfileDollar(t *testing.T) {
+	long := strings.Repeat("x", 100*1000)
+	node := &DepNode{Output: "out", Cmds: []string{"echo $$HOME '$$(pwd)' $@ " + long}, HasRule: true}
+	got := genNinjaForTest(t, &NinjaGenerator{}, []*DepNode{node}, "")
+	// literal dollars are escaped for ninja, but ${out} is not.
+	if want := " rspfile_content = echo $$HOME '$$(pwd)' ${out} " + long + "\n"; !strings.Contains(got, want) {
+		t.Errorf("output doesn't contain %.80q...\n%.500s", want, got)
+	}
+}
+
+func TestGetDepfileExported(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		in      string
+		cmd     string
+		depfile string
+		err     bool
+	}{
+		{
+			name: "not a compile command",
+			in:   "cp foo.c foo.o",
+			cmd:  "cp foo.c foo.o",
+		},
+		{
+			name:    "automake mv",
+			in:      "gcc -MD -MF .deps/a.Tpo -c -o a.o a.c && (mv -f .deps/a.Tpo .deps/a.Po)",
+			cmd:     "gcc -MD -MF .deps/a.Tpo -c -o a.o a.c && (cp -f .deps/a.Tpo .deps/a.Po)",
+			depfile: ".deps/a.Tpo",
+		},
+		{
+			name:    ".P file",
+			in:      "gcc -MD -c foo.c -o out/foo.o; cp out/foo.d out/foo.P; rm -f out/foo.d",
+			cmd:     "gcc -MD -c foo.c -o out/foo.o; cp out/foo.d out/foo.P",
+			depfile: "out/foo.P",
+		},
+		{
+			name: ".P file without removal of .d",
+			in:   "gcc -MD -c foo.c -o out/foo.o; cp out/foo.d out/foo.P",
+			cmd:  "gcc -MD -c foo.c -o out/foo.o; cp out/foo.d out/foo.P",
+			err:  true,
+		},
+		{
+			name: ".s by gcc",
+			in:   "prebuilts/gcc/bin/arm-linux-androideabi-gcc -MD -c src/foo.s -o out/foo.o",
+			cmd:  "prebuilts/gcc/bin/arm-linux-androideabi-gcc -MD -c src/foo.s -o out/foo.o",
+		},
+		{
+			name:    ".tmp copy",
+			in:      "gcc -MD -c foo.c -o out/foo.o",
+			cmd:     "gcc -MD -c foo.c -o out/foo.o && cp out/foo.d out/foo.d.tmp",
+			depfile: "out/foo.d.tmp",
+		},
+		{
+			name:    "multiple dots",
+			in:      "gcc -MD -c foo.c -o out/a.b.o",
+			cmd:     "gcc -MD -c foo.c -o out/a.b.o && cp out/a.b.d out/a.b.d.tmp",
+			depfile: "out/a.b.d.tmp",
+		},
+		{
+			name:    "dots in directory",
+			in:      "gcc -MD -c foo.c -o ./a.b/c.o",
+			cmd:     "gcc -MD -c foo.c -o ./a.b/c.o && cp ./a.b/c.d ./a.b/c.d.tmp",
+			depfile: "./a.b/c.d.tmp",
+		},
+		{
+			name:    "no extension",
+			in:      "gcc -MD -c foo.c -o dir.x/y",
+			cmd:     "gcc -MD -c foo.c -o dir.x/y && cp dir.x/y.d dir.x/y.d.tmp",
+			depfile: "dir.x/y.d.tmp",
+		},
+		{
+			name: "multiple -MF",
+			in:   "gcc -MD -MF a.d -MF b.d -c foo.c -o foo.o",
+			cmd:  "gcc -MD -MF a.d -MF b.d -c foo.c -o foo.o",
+			err:  true,
+		},
+	} {
+		cmd, depfile, err := GetDepfile(tc.in)
+		if tc.err != (err != nil) {
+			t.Errorf("%s: GetDepfile(%q) error=%v; want error=%t", tc.name, tc.in, err, tc.err)
+		}
+		if cmd != tc.cmd || depfile != tc.depfile {
+			t.Errorf("%s: GetDepfile(%q)=%q, %q; want %q, %q", tc.name, tc.in, cmd, depfile, tc.cmd, tc.depfile)
+		}
+	}
+}
+
+func TestStripShellCommentExported(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: "echo foo # comment", want: "echo foo "},
+		{in: "echo '# not a comment'", want: "echo '# not a comment'"},
+		{in: "echo foo#bar", want: "echo foo#bar"},
+	} {
+		if got := StripShellComment(tc.in); got != tc.want {
+			t.Errorf("StripShellComment(%q)=%q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestNinjaRspfileForLinks(t *testing.T) {
+	for _, tc := range []struct {
+		cmd   string
+		force bool
+		rsp   bool
+	}{
+		{cmd: "prebuilts/gcc/bin/ld -o $@ foo.o", rsp: false},
+		{cmd: "prebuilts/gcc/bin/ld -o $@ foo.o", force: true, rsp: true},
+		{cmd: "ar rcs $@ foo.o", force: true, rsp: true},
+		{cmd: "gcc -c foo.c -o $@", force: true, rsp: false},
+	} {
+		node := &DepNode{Output: "out", Cmds: []string{tc.cmd}, HasRule: true}
+		got := genNinjaForTest(t, &NinjaGenerator{RspfileForLinks: tc.force}, []*DepNode{node}, "")
+		if rsp := strings.Contains(got, " rspfile = $out.rsp\n"); rsp != tc.rsp {
+			t.Errorf("%q: RspfileForLinks=%t: rspfile=%t; want %t\n%s", tc.cmd, tc.force, rsp, tc.rsp, got)
+		}
+		if tc.rsp && !strings.Contains(got, " command = /bin/sh $out.rsp\n") {
+			t.Errorf("%q: command doesn't run the rspfile\n%s", tc.cmd, got)
+		}
+	}
+}
+
+func TestNinjaGenAllTargets(t *testing.T) {
+	defer inTempDir(t)()
+
+	err := ioutil.WriteFile("Makefile", []byte(`
+all: foo
+foo:
+	touch $@
+unreachable: bar
+	touch $@
+bar:
+	touch $@
+.PHONY: all
+.SUFFIXES:
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		targets []string
+		genAll  bool
+		all     bool
+		want    []string
+	}{
+		{
+			targets: []string{"all"},
+			want:    []string{"all", "foo"},
+		},
+		{
+			targets: []string{"all"},
+			all:     true,
+			want:    []string{"all", "bar", "foo", "unreachable"},
+		},
+		{
+			targets: []string{"foo"},
+			want:    []string{"foo"},
+		},
+		{
+			targets: []string{"foo"},
+			genAll:  true,
+			want:    []string{"all", "foo"},
+		},
+	} {
+		g, err := Load(LoadReq{Makefile: "Makefile", Targets: []string{"all"}, AllTargets: tc.all})
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		n := &NinjaGenerator{GenAll: tc.genAll, GenAllTargets: tc.all}
+		err = n.Save(g, "", tc.targets)
+		if err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		if !reflect.DeepEqual(n.Emitted, tc.want) {
+			t.Errorf("GenAll=%t GenAllTargets=%t: n.Emitted=%q; want %q", tc.genAll, tc.all, n.Emitted, tc.want)
+		}
+	}
+}
+
+func TestNinjaEmitProvenance(t *testing.T) {
+	nodes := []*DepNode{
+		{Output: "a", Cmds: []string{"touch $@"}, HasRule: true, Filename: "dir/foo.mk", Lineno: 12},
+		{Output: "b", Cmds: []string{"touch $@"}, HasRule: true, Filename: "evil\nbuild x: phony # .mk", Lineno: 3},
+		{Output: "c", Cmds: []string{"touch $@"}, HasRule: true},
+	}
+	for _, emit := range []bool{false, true} {
+		got := genNinjaForTest(t, &NinjaGenerator{EmitProvenance: emit}, nodes, "")
+		if !emit {
+			if strings.Contains(got, "# defined at") {
+				t.Errorf("EmitProvenance=false: output has provenance\n%s", got)
+			}
+			continue
+		}
+		for _, want := range []string{
+			"# rule for \"a\"\n# defined at dir/foo.mk:12\nrule ",
+			"# rule for \"b\"\n# defined at \"evil\\nbuild x: phony # .mk\":3\nrule ",
+			"# rule for \"c\"\nrule ",
+		} {
+			if !strings.Contains(got, want) {
+				t.Errorf("output doesn't contain %q\n%s", want, got)
+			}
+		}
+		if strings.Contains(got, "\nbuild x:") {
+			t.Errorf("filename breaks the ninja file\n%s", got)
+		}
+	}
+}
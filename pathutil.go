@@ -21,6 +21,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -50,6 +51,8 @@ type fsCacheT struct {
 	mu      sync.Mutex
 	ids     map[string]fileid
 	dirents map[fileid][]dirent
+	// globDirs is directories scanned by Glob.
+	globDirs map[string]bool
 }
 
 var fsCache = &fsCacheT{
@@ -57,6 +60,7 @@ var fsCache = &fsCacheT{
 	dirents: map[fileid][]dirent{
 		invalidFileid: nil,
 	},
+	globDirs: make(map[string]bool),
 }
 
 func init() {
@@ -69,6 +73,18 @@ func (c *fsCacheT) dirs() int {
 	return len(c.dirents)
 }
 
+// globbedDirs returns sorted directories scanned by Glob.
+func (c *fsCacheT) globbedDirs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var dirs []string
+	for dir := range c.globDirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
 func (c *fsCacheT) files() int {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -235,7 +251,13 @@ func (c *fsCacheT) readdir(dir string, id fileid) (fileid, []dirent) {
 // glob searches for files matching pattern in the directory dir
 // and appends them to matches. ignore I/O errors.
 func (c *fsCacheT) glob(dir, pattern string, matches []string) ([]string, error) {
-	_, ents := c.readdir(filepathClean(dir), unknownFileid)
+	cdir := filepathClean(dir)
+	id, ents := c.readdir(cdir, unknownFileid)
+	if id != invalidFileid {
+		c.mu.Lock()
+		c.globDirs[cdir] = true
+		c.mu.Unlock()
+	}
 	switch dir {
 	case "", string(filepath.Separator):
 		// nothing
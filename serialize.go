@@ -114,6 +114,7 @@ type serializableVar struct {
 
 type serializableDepNode struct {
 	Output             int
+	ImplicitOutputs    []int
 	Cmds               []string
 	Deps               []int
 	OrderOnlys         []int
@@ -124,6 +125,11 @@ type serializableDepNode struct {
 	TargetSpecificVars []int
 	Filename           string
 	Lineno             int
+	Package            string
+	Pool               string
+	NotParallel        bool
+	Description        string
+	Generator          bool
 }
 
 type serializableTargetSpecificVar struct {
@@ -132,13 +138,16 @@ type serializableTargetSpecificVar struct {
 }
 
 type serializableGraph struct {
-	Nodes       []*serializableDepNode
-	Vars        map[string]serializableVar
-	Tsvs        []serializableTargetSpecificVar
-	Targets     []string
-	Roots       []string
-	AccessedMks []*accessedMakefile
-	Exports     map[string]bool
+	Nodes         []*serializableDepNode
+	Vars          map[string]serializableVar
+	Tsvs          []serializableTargetSpecificVar
+	Targets       []string
+	Roots         []string
+	AccessedMks   []*accessedMakefile
+	Exports       map[string]bool
+	GlobDirs      []string
+	OneShell      bool
+	DeleteOnError bool
 }
 
 func encGob(v interface{}) (string, error) {
@@ -197,6 +206,10 @@ func (ns *depNodesSerializer) serializeDepNodes(nodes []*DepNode) {
 		}
 		ns.done[n.Output] = true
 
+		var implicitOutputs []int
+		for _, o := range n.ImplicitOutputs {
+			implicitOutputs = append(implicitOutputs, ns.serializeTarget(o))
+		}
 		var deps []int
 		for _, d := range n.Deps {
 			deps = append(deps, ns.serializeTarget(d.Output))
@@ -242,6 +255,7 @@ func (ns *depNodesSerializer) serializeDepNodes(nodes []*DepNode) {
 
 		ns.nodes = append(ns.nodes, &serializableDepNode{
 			Output:             ns.serializeTarget(n.Output),
+			ImplicitOutputs:    implicitOutputs,
 			Cmds:               n.Cmds,
 			Deps:               deps,
 			OrderOnlys:         orderonlys,
@@ -252,6 +266,11 @@ func (ns *depNodesSerializer) serializeDepNodes(nodes []*DepNode) {
 			TargetSpecificVars: vars,
 			Filename:           n.Filename,
 			Lineno:             n.Lineno,
+			Package:            n.Package,
+			Pool:               n.Pool,
+			NotParallel:        n.NotParallel,
+			Description:        n.Description,
+			Generator:          n.Generator,
 		})
 		ns.serializeDepNodes(n.Deps)
 		if ns.err != nil {
@@ -277,13 +296,16 @@ func makeSerializableGraph(g *DepGraph, roots []string) (serializableGraph, erro
 	ns.serializeDepNodes(g.nodes)
 	v := makeSerializableVars(g.vars)
 	return serializableGraph{
-		Nodes:       ns.nodes,
-		Vars:        v,
-		Tsvs:        ns.tsvs,
-		Targets:     ns.targets,
-		Roots:       roots,
-		AccessedMks: g.accessedMks,
-		Exports:     g.exports,
+		Nodes:         ns.nodes,
+		Vars:          v,
+		Tsvs:          ns.tsvs,
+		Targets:       ns.targets,
+		Roots:         roots,
+		AccessedMks:   g.accessedMks,
+		Exports:       g.exports,
+		GlobDirs:      g.globDirs,
+		OneShell:      g.oneShell,
+		DeleteOnError: g.deleteOnError,
 	}, ns.err
 }
 
@@ -528,6 +550,10 @@ func deserializeNodes(g serializableGraph) (r []*DepNode, err error) {
 
 	nodeMap := make(map[string]*DepNode)
 	for _, n := range nodes {
+		var implicitOutputs []string
+		for _, o := range n.ImplicitOutputs {
+			implicitOutputs = append(implicitOutputs, targets[o])
+		}
 		var actualInputs []string
 		for _, i := range n.ActualInputs {
 			actualInputs = append(actualInputs, targets[i])
@@ -535,12 +561,18 @@ func deserializeNodes(g serializableGraph) (r []*DepNode, err error) {
 
 		d := &DepNode{
 			Output:             targets[n.Output],
+			ImplicitOutputs:    implicitOutputs,
 			Cmds:               n.Cmds,
 			HasRule:            n.HasRule,
 			IsPhony:            n.IsPhony,
 			ActualInputs:       actualInputs,
 			Filename:           n.Filename,
 			Lineno:             n.Lineno,
+			Package:            n.Package,
+			Pool:               n.Pool,
+			NotParallel:        n.NotParallel,
+			Description:        n.Description,
+			Generator:          n.Generator,
 			TargetSpecificVars: make(Vars),
 		}
 
@@ -701,10 +733,13 @@ func deserializeGraph(g serializableGraph) (*DepGraph, error) {
 		return nil, err
 	}
 	return &DepGraph{
-		nodes:       nodes,
-		vars:        vars,
-		accessedMks: g.AccessedMks,
-		exports:     g.Exports,
+		nodes:         nodes,
+		vars:          vars,
+		accessedMks:   g.AccessedMks,
+		exports:       g.Exports,
+		globDirs:      g.GlobDirs,
+		oneShell:      g.OneShell,
+		deleteOnError: g.DeleteOnError,
 	}, nil
 }
 
@@ -15,6 +15,7 @@
 package kati
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -230,3 +231,44 @@ func (p *shellParser) expectSeq(toks ...string) error {
 	}
 	return nil
 }
+
+// shellWord returns the word at the beginning of s with its quotes
+// and backslashes removed, and the length of the word in s.  s must
+// not begin with a space.
+func shellWord(s string) (string, int) {
+	var buf bytes.Buffer
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+				continue
+			}
+		case c == '\\' && i+1 < len(s) && (quote == 0 || strings.IndexByte("$`\"\\\n", s[i+1]) >= 0):
+			i++
+			c = s[i]
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+				continue
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			continue
+		case isWhitespace(rune(c)):
+			return buf.String(), i
+		}
+		buf.WriteByte(c)
+	}
+	return buf.String(), len(s)
+}
+
+// shellQuote quotes s as a word of shell if it has special characters.
+func shellQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n'\"\\$`;&|()<>*?[]#~!{}") {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -100,3 +100,40 @@ func TestShellDate(t *testing.T) {
 		}
 	}
 }
+
+func TestShellWord(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		word string
+		n    int
+	}{
+		{in: "foo.o -c", word: "foo.o", n: 5},
+		{in: "foo.o", word: "foo.o", n: 5},
+		{in: `"out dir/foo.o" -c`, word: "out dir/foo.o", n: 15},
+		{in: `'out dir'/foo.o`, word: "out dir/foo.o", n: 15},
+		{in: `out\ dir/foo.o x`, word: "out dir/foo.o", n: 14},
+		{in: `"a\"b" c`, word: `a"b`, n: 6},
+		{in: `'a\b' c`, word: `a\b`, n: 5},
+	} {
+		word, n := shellWord(tc.in)
+		if word != tc.word || n != tc.n {
+			t.Errorf("shellWord(%q)=%q, %d; want=%q, %d", tc.in, word, n, tc.word, tc.n)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: "out/foo.d", want: "out/foo.d"},
+		{in: "out dir/foo.d", want: "'out dir/foo.d'"},
+		{in: "it's", want: `'it'\''s'`},
+		{in: "", want: "''"},
+	} {
+		if got := shellQuote(tc.in); got != tc.want {
+			t.Errorf("shellQuote(%q)=%q; want=%q", tc.in, got, tc.want)
+		}
+	}
+}
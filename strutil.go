@@ -54,6 +54,31 @@ func splitSpaces(s string) []string {
 	return r
 }
 
+// splitSpacesEscaped is like splitSpaces, but a whitespace escaped by
+// a backslash doesn't split words.  Backslashes are kept as is.
+func splitSpacesEscaped(s string) []string {
+	var r []string
+	tokStart := -1
+	escaped := false
+	for i, ch := range s {
+		if isWhitespace(ch) && !escaped {
+			if tokStart >= 0 {
+				r = append(r, s[tokStart:i])
+				tokStart = -1
+			}
+			continue
+		}
+		if tokStart < 0 {
+			tokStart = i
+		}
+		escaped = ch == '\\' && !escaped
+	}
+	if tokStart >= 0 {
+		r = append(r, s[tokStart:])
+	}
+	return r
+}
+
 func splitSpacesBytes(s []byte) (r [][]byte) {
 	tokStart := -1
 	for i, ch := range s {
@@ -53,6 +53,35 @@ func TestSplitSpaces(t *testing.T) {
 	}
 }
 
+func TestSplitSpacesEscaped(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{
+			in:   " foo  bar ",
+			want: []string{"foo", "bar"},
+		},
+		{
+			in:   `my\ dir/Makefile foo.mk`,
+			want: []string{`my\ dir/Makefile`, "foo.mk"},
+		},
+		{
+			in:   `foo\\ bar`,
+			want: []string{`foo\\`, "bar"},
+		},
+		{
+			in:   `foo\`,
+			want: []string{`foo\`},
+		},
+	} {
+		got := splitSpacesEscaped(tc.in)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf(`splitSpacesEscaped(%q)=%q, want %q`, tc.in, got, tc.want)
+		}
+	}
+}
+
 func TestWordScanner(t *testing.T) {
 	for _, tc := range []struct {
 		in   string
@@ -251,3 +280,21 @@ func TestConcatline(t *testing.T) {
 		}
 	}
 }
+
+func TestStripExt(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: "foo.o", want: "foo"},
+		{in: "a.b.o", want: "a.b"},
+		{in: "dir.x/y.o", want: "dir.x/y"},
+		{in: "./a.b/c.o", want: "./a.b/c"},
+		{in: "dir.x/y", want: "dir.x/y"},
+		{in: "out/foo", want: "out/foo"},
+	} {
+		if got := stripExt(tc.in); got != tc.want {
+			t.Errorf("stripExt(%q)=%q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
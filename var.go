@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 )
 
 // Var is an interface of make variable.
@@ -216,8 +217,7 @@ func (v *recursiveVar) IsDefined() bool { return true }
 
 func (v *recursiveVar) String() string { return v.expr.String() }
 func (v *recursiveVar) Eval(w evalWriter, ev *Evaluator) error {
-	v.expr.Eval(w, ev)
-	return nil
+	return v.expr.Eval(w, ev)
 }
 func (v *recursiveVar) serialize() serializableVar {
 	return serializableVar{
@@ -292,14 +292,20 @@ func (undefinedVar) AppendVar(_ *Evaluator, val Value) (Var, error) {
 // Vars is a map for make variables.
 type Vars map[string]Var
 
-// usedEnvs tracks what environment variables are used.
-var usedEnvs = map[string]bool{}
+// usedEnvs tracks what environment variables are used.  It is
+// guarded by usedEnvsMu, as recipes may be evaluated in parallel.
+var (
+	usedEnvsMu sync.Mutex
+	usedEnvs   = map[string]bool{}
+)
 
 // Lookup looks up named make variable.
 func (vt Vars) Lookup(name string) Var {
 	if v, ok := vt[name]; ok {
 		if strings.HasPrefix(v.Origin(), "environment") {
+			usedEnvsMu.Lock()
 			usedEnvs[name] = true
+			usedEnvsMu.Unlock()
 		}
 		return v
 	}
@@ -129,11 +129,35 @@ func getTimestamp(filename string) int64 {
 	return st.ModTime().Unix()
 }
 
+// checkFutureTimestamp returns ts of filename, or now if ts is in the
+// future, e.g. by clock skew of network filesystems, so the file
+// doesn't look newer than files built after it.  If
+// NormalizeFutureMtimeFlag is set, it also resets mtime of the file.
+func checkFutureTimestamp(filename string, ts, now int64) int64 {
+	if ts <= now {
+		return ts
+	}
+	glog.Warningf("file %q has modification time %d s in the future", filename, ts-now)
+	if NormalizeFutureMtimeFlag {
+		t := time.Unix(now, 0)
+		err := os.Chtimes(filename, t, t)
+		if err != nil {
+			glog.Warningf("normalize mtime of %q: %v", filename, err)
+		}
+	}
+	return now
+}
+
 func (j *job) build() error {
 	if j.n.IsPhony {
 		j.outputTs = -2 // trigger cmd even if all inputs don't exist.
 	} else {
 		j.outputTs = getTimestamp(j.n.Output)
+		// an output in the future is only clamped here, and is
+		// warned about once after its recipe runs.
+		if now := time.Now().Unix(); j.outputTs > now {
+			j.outputTs = now
+		}
 	}
 
 	if !j.n.HasRule {
@@ -170,10 +194,12 @@ func (j *job) build() error {
 	if j.n.IsPhony {
 		j.outputTs = time.Now().Unix()
 	} else {
+		now := time.Now().Unix()
 		j.outputTs = getTimestamp(j.n.Output)
 		if j.outputTs < 0 {
-			j.outputTs = time.Now().Unix()
+			j.outputTs = now
 		}
+		j.outputTs = checkFutureTimestamp(j.n.Output, j.outputTs, now)
 	}
 	return nil
 }
@@ -0,0 +1,64 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckFutureTimestamp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "out")
+	err = ioutil.WriteFile(filename, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	future := time.Unix(now+3600, 0)
+	err = os.Chtimes(filename, future, future)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := checkFutureTimestamp(filename, now-1, now); got != now-1 {
+		t.Errorf("checkFutureTimestamp(%q, now-1, now)=%d; want=%d", filename, got, now-1)
+	}
+
+	defer func(flag bool) {
+		NormalizeFutureMtimeFlag = flag
+	}(NormalizeFutureMtimeFlag)
+	for _, normalize := range []bool{false, true} {
+		NormalizeFutureMtimeFlag = normalize
+		ts := getTimestamp(filename)
+		if got := checkFutureTimestamp(filename, ts, now); got != now {
+			t.Errorf("checkFutureTimestamp(%q, %d, %d)=%d; want=%d", filename, ts, now, got, now)
+		}
+		want := future.Unix()
+		if normalize {
+			want = now
+		}
+		if got := getTimestamp(filename); got != want {
+			t.Errorf("normalize=%t: timestamp=%d; want=%d", normalize, got, want)
+		}
+	}
+}